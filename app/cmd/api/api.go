@@ -1,6 +1,8 @@
 package api
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -54,7 +56,11 @@ func (api *API) StoreData(ctx *gin.Context) {
 	}
 
 	// Store the data
-	hash := api.Net.Node.Store([]byte(requestBody.Data))
+	hash, err := api.Net.Node.Store(ctx.Request.Context(), []byte(requestBody.Data))
+	if err != nil {
+		ctx.JSON(statusForError(err), gin.H{"error": err.Error()})
+		return
+	}
 
 	// Set the Location header
 	locationHeader := "/objects/" + hash
@@ -68,7 +74,11 @@ func (api *API) GetData(ctx *gin.Context) {
 	hash := ctx.Param("hash")
 
 	// Lookup the data and contact based on the hash
-	_, data, contact := api.Net.Node.Lookup(hash)
+	data, contact, err := api.Net.Node.LookupData(ctx.Request.Context(), hash)
+	if err != nil {
+		ctx.JSON(statusForError(err), gin.H{"error": err.Error()})
+		return
+	}
 
 	// If data is not found, return a 404 Not Found response
 	if data == nil {
@@ -85,3 +95,25 @@ func (api *API) GetData(ctx *gin.Context) {
 	// Respond with the contents of the object and contact information
 	ctx.JSON(http.StatusOK, res)
 }
+
+// statusForError maps errors from the node to the HTTP status we answer with
+func statusForError(err error) int {
+	var remoteErr *internal.RemoteError
+	switch {
+	case errors.Is(err, internal.ErrValueTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, internal.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.As(err, &remoteErr) && remoteErr.Code == internal.CodeNotFound:
+		return http.StatusNotFound
+	case errors.As(err, &remoteErr) && remoteErr.Code == internal.CodeValueTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, internal.ErrRemote), errors.Is(err, internal.ErrBadResponse):
+		return http.StatusBadGateway
+	case errors.Is(err, internal.ErrNotListening), errors.Is(err, internal.ErrSendFailed),
+		errors.Is(err, internal.ErrNodeClosed):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
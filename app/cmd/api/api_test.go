@@ -0,0 +1,73 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/arek-e/D7024E/app/internal"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusForError(t *testing.T) {
+	tests := map[error]int{
+		internal.ErrValueTooLarge:                               http.StatusRequestEntityTooLarge,
+		internal.ErrTimeout:                                     http.StatusGatewayTimeout,
+		context.DeadlineExceeded:                                http.StatusGatewayTimeout,
+		&internal.RemoteError{Code: internal.CodeNotFound}:      http.StatusNotFound,
+		&internal.RemoteError{Code: internal.CodeValueTooLarge}: http.StatusRequestEntityTooLarge,
+		&internal.RemoteError{Code: internal.CodeInternal}:      http.StatusBadGateway,
+		internal.ErrBadResponse:                                 http.StatusBadGateway,
+		internal.ErrNotListening:                                http.StatusServiceUnavailable,
+		internal.ErrSendFailed:                                  http.StatusServiceUnavailable,
+		internal.ErrNodeClosed:                                  http.StatusServiceUnavailable,
+		errors.New("anything"):                                  http.StatusInternalServerError,
+	}
+	for err, status := range tests {
+		assert.Equal(t, status, statusForError(err), "%v", err)
+
+		// Errors arrive wrapped with details and joined from several peers
+		wrapped := fmt.Errorf("from 10.0.0.1:1337: %w", err)
+		assert.Equal(t, status, statusForError(errors.Join(wrapped, wrapped)), "%v", err)
+	}
+}
+
+func TestGetDataWhenNoPeerAnswers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	switchboard := internal.NewSwitchboard()
+	node := internal.NewKademliaNode("10.0.0.1:1337")
+	network := &internal.Network{Node: &node}
+	transport, _ := switchboard.Listen(node.Self.Address)
+	go network.Serve(context.Background(), transport)
+	t.Cleanup(func() { node.Close() })
+
+	// The only contact is gone, so every request times out
+	network.SetRetryPolicy("FindDataRequest", internal.RetryPolicy{Timeout: 20 * time.Millisecond})
+	node.Routes.AddContact(internal.NewContact(internal.NewRandomKademliaID(), "10.0.0.2:1337"))
+
+	api := &API{Node: &node, Net: network}
+	router := gin.New()
+	router.GET("/objects/:hash", api.GetData)
+
+	get := func() int {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, "/objects/"+internal.NewRandomKademliaID().String(), nil)
+		router.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+	assert.Equal(t, http.StatusGatewayTimeout, get())
+
+	// Once a peer answers, missing data is just not there
+	peer := internal.NewKademliaNode("10.0.0.3:1337")
+	peerTransport, _ := switchboard.Listen(peer.Self.Address)
+	go (&internal.Network{Node: &peer}).Serve(context.Background(), peerTransport)
+	t.Cleanup(func() { peer.Close() })
+	node.Routes.AddContact(peer.Self)
+	assert.Equal(t, http.StatusNotFound, get())
+}
@@ -1,6 +1,8 @@
 package cli
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -97,6 +99,7 @@ func (cli *CLI) StartCLI(exitCh chan<- struct{}) {
 		case "exit", "q":
 			fmt.Println("Exiting the CLI...")
 			exitCh <- struct{}{}
+			return
 		default:
 			fmt.Println("Command not recognized. Available Commands: ping, put, get, forget, exit")
 		}
@@ -172,13 +175,20 @@ func (cli *CLI) pingCmd(ipAddress string) {
 	}
 
 	_, err := cli.Net.SendPingMessage(&contact)
-	if err != nil {
-		fmt.Errorf("ERROR: %v", err)
+	switch {
+	case errors.Is(err, internal.ErrTimeout):
+		fmt.Printf("No answer from %s\n", ipAddress)
+	case err != nil:
+		fmt.Printf("ERROR: %v\n", err)
 	}
 }
 
 func (cli *CLI) putCmd(dataToStore string) {
-	hash := cli.Net.Node.Store([]byte(dataToStore))
+	hash, err := cli.Net.Node.Store(context.Background(), []byte(dataToStore))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
 
 	fmt.Printf("Data was stored at %v\n", hash)
 
@@ -202,7 +212,7 @@ func (cli *CLI) putCmd(dataToStore string) {
 }
 
 func (cli *CLI) getCmd(hash string) {
-	_, data, contact := cli.Net.Node.Lookup(hash)
+	_, data, contact := cli.Net.Node.Lookup(context.Background(), hash)
 	fmt.Printf("\nFound data: %s\nFrom contact: %s\n", data, &contact)
 }
 
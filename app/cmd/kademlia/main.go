@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"log"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 
 	"github.com/arek-e/D7024E/app/cmd/api"
 	"github.com/arek-e/D7024E/app/cmd/cli"
@@ -12,7 +18,21 @@ import (
 
 var port = 1337
 
+var (
+	dataDir       = flag.String("data-dir", "data", "directory the node identity is kept in")
+	staticPuzzle  = flag.Int("puzzle-static", 0, "leading zero bits of the static node ID puzzle, 0 to turn it off")
+	dynamicPuzzle = flag.Int("puzzle-dynamic", 0, "leading zero bits of the dynamic node ID puzzle, 0 to turn it off")
+	encrypt       = flag.Bool("encrypt", false, "encrypt the RPCs sent to other nodes")
+	swarmKeyFile  = flag.String("swarm-key-file", "", "file with the pre-shared key of a private network, empty for a public network")
+)
+
 func main() {
+	flag.Parse()
+
+	// Cancelled on SIGINT/SIGTERM so the node can shut down cleanly
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Gets the docker containers IP
 	localIP := utils.GetOutboundIP()
 	fmt.Printf("LocalIP: %s\n", localIP.String())
@@ -20,26 +40,52 @@ func main() {
 	// Combines the ip with port 172.20.0.3 + ":" + port
 	localAdress := fmt.Sprintf("%s:%d", localIP.String(), port)
 
-	self := internal.NewKademliaNode(localAdress)
+	// The node keeps its ID across restarts and address changes
+	difficulty := internal.PuzzleDifficulty{Static: *staticPuzzle, Dynamic: *dynamicPuzzle}
+	identity, err := internal.LoadIdentity(*dataDir, difficulty)
+	if err != nil {
+		log.Fatalf("Error loading identity from %s: %v", *dataDir, err)
+	}
+
+	self := internal.NewKademliaNodeWithIdentity(localAdress, identity)
+	fmt.Printf("Node ID: %s\n", self.Self.ID)
 
 	network := &internal.Network{}
 	network.Node = &self
+	network.SetPuzzleDifficulty(difficulty)
+	network.SetEncryption(*encrypt)
+
+	// Only nodes with the same key can talk to each other
+	if *swarmKeyFile != "" {
+		key, err := internal.ReadSwarmKey(*swarmKeyFile)
+		if err != nil {
+			log.Fatalf("Error reading swarm key: %v", err)
+		}
+		network.SetSwarmKey(key)
+	}
 
 	bootstrapNodeID := internal.NewRandomKademliaID()
 	// Gets the boostrap ip address "172.20.0.2"
 	bootstrapNodeAddress := utils.GetBootstrapAddress(localIP.String(), strconv.Itoa(port))
 	bootstrapNodeContact := internal.NewContact(bootstrapNodeID, bootstrapNodeAddress)
 
+	// The listening socket is also used for outgoing RPCs, so it has to be up
+	// before we try to join
+	go func() {
+		if err := network.Listen(ctx, localIP.String(), port); err != nil {
+			log.Printf("Error listening: %v", err)
+			stop()
+		}
+	}()
+
 	// checkar ifall noden finns eller inte nätverket. Om den inte gör så den med
 	// checkar även ifall det är självaste bootstrap noden
 	if localAdress != bootstrapNodeAddress {
-		self.JoinNetwork(&bootstrapNodeContact)
+		self.JoinNetwork(ctx, &bootstrapNodeContact)
 	} else {
 		fmt.Printf("Bootstrap node started listening\n")
 	}
 
-	go network.Listen(localIP.String(), port)
-
 	cli := &cli.CLI{
 		Node: &self,
 		Net:  network,
@@ -54,6 +100,14 @@ func main() {
 	go cli.StartCLI(exitCh)
 	go api.StartAPI(localIP.String(), exitCh)
 
-	// Wait for the exit signal from the CLI
-	<-exitCh
+	// Wait for the exit signal from the CLI or the OS
+	select {
+	case <-exitCh:
+	case <-ctx.Done():
+	}
+
+	fmt.Println("Shutting down...")
+	if err := self.Close(); err != nil {
+		log.Printf("Error shutting down: %v", err)
+	}
 }
@@ -2,57 +2,114 @@ package internal
 
 import (
 	"container/list"
+	"time"
 )
 
+// How many candidates a full bucket remembers for when one of its contacts
+// goes away
+const replacementCacheSize = bucketSize
+
 // bucket definition
-// contains a List
+// contains a List, most recently seen contact first, and the replacement
+// cache of contacts that did not fit
 type bucket struct {
-	list *list.List
+	list         *list.List
+	replacements *list.List
+	lastActivity time.Time // Last time a contact was seen or a lookup went through the bucket
+	health       map[KademliaID]*ContactHealth
 }
 
 // newBucket returns a new instance of a bucket
 func newBucket() *bucket {
 	bucket := &bucket{}
 	bucket.list = list.New()
+	bucket.replacements = list.New()
+	bucket.lastActivity = time.Now()
+	bucket.health = make(map[KademliaID]*ContactHealth)
 	return bucket
 }
 
 // AddContact adds the Contact to the front of the bucket
-// or moves it to the front of the bucket if it already existed
-func (bucket *bucket) AddContact(contact Contact) {
-	var element *list.Element
-	for e := bucket.list.Front(); e != nil; e = e.Next() {
-		nodeID := e.Value.(Contact).ID
-
-		if (contact).ID.Equals(nodeID) {
-			element = e
+// or moves it to the front of the bucket if it already existed.
+// A known contact keeps the address it was last seen on.
+//
+// A new contact does not push anyone out of a full bucket, long-lived
+// contacts are the most likely to stay. It goes to the replacement cache
+// instead, and the least recently seen contact is returned so it can be
+// pinged: if it answers it moves to the front, otherwise RemoveContact
+// makes room for the newest replacement.
+func (bucket *bucket) AddContact(contact Contact) (leastRecent Contact, full bool) {
+	bucket.lastActivity = time.Now()
+
+	if element := find(bucket.list, contact.ID); element != nil {
+		element.Value = contact
+		bucket.list.MoveToFront(element)
+		bucket.seen(contact.ID)
+		return Contact{}, false
+	}
+
+	if bucket.list.Len() < bucketSize {
+		bucket.list.PushFront(contact)
+		bucket.seen(contact.ID)
+		return Contact{}, false
+	}
+
+	if element := find(bucket.replacements, contact.ID); element != nil {
+		element.Value = contact
+		bucket.replacements.MoveToFront(element)
+	} else {
+		bucket.replacements.PushFront(contact)
+		if bucket.replacements.Len() > replacementCacheSize {
+			bucket.replacements.Remove(bucket.replacements.Back())
 		}
 	}
+	return bucket.list.Back().Value.(Contact), true
+}
 
-	if element == nil {
-		if bucket.list.Len() < bucketSize {
-			bucket.list.PushFront(contact)
+// find returns the element of the contact with the ID, or nil
+func find(contacts *list.List, id *KademliaID) *list.Element {
+	for e := contacts.Front(); e != nil; e = e.Next() {
+		if e.Value.(Contact).ID.Equals(id) {
+			return e
 		}
-	} else {
-		bucket.list.MoveToFront(element)
 	}
+	return nil
 }
 
-func (bucket *bucket) RemoveContact(contact Contact) {
-	var element *list.Element
-	for e := bucket.list.Front(); e != nil; e = e.Next() {
-		nodeID := e.Value.(Contact).ID
+// Contains reports whether a contact with the ID is in the bucket
+func (bucket *bucket) Contains(id *KademliaID) bool {
+	return find(bucket.list, id) != nil
+}
 
-		if (contact).ID.Equals(nodeID) {
-			element = e
-		}
+// RemoveContact removes the contact from the bucket or its replacement
+// cache. The slot it leaves in the bucket goes to the most recently seen
+// replacement, at the back since it has not been seen since it was cached.
+func (bucket *bucket) RemoveContact(contact Contact) {
+	if element := find(bucket.replacements, contact.ID); element != nil {
+		bucket.replacements.Remove(element)
 	}
+
+	element := find(bucket.list, contact.ID)
 	// Element was found, meaning it is not nil and will be removed
 	if element != nil {
 		bucket.list.Remove(element)
+		delete(bucket.health, *contact.ID)
+
+		if replacement := bucket.replacements.Front(); replacement != nil {
+			bucket.list.PushBack(bucket.replacements.Remove(replacement))
+		}
 	}
 }
 
+// Replacements returns the replacement cache, most recently seen first
+func (bucket *bucket) Replacements() []Contact {
+	var contacts []Contact
+	for e := bucket.replacements.Front(); e != nil; e = e.Next() {
+		contacts = append(contacts, e.Value.(Contact))
+	}
+	return contacts
+}
+
 // GetContactAndCalcDistance returns an array of Contacts where
 // the Distance has already been calculated
 func (bucket *bucket) GetContactAndCalcDistance(target *KademliaID) []Contact {
@@ -1,8 +1,11 @@
 package internal
 
 import (
-	"github.com/arek-e/D7024E/app/utils"
+	"fmt"
 	"testing"
+
+	"github.com/arek-e/D7024E/app/utils"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestRemove(t *testing.T) {
@@ -25,3 +28,44 @@ func TestRemove(t *testing.T) {
 	}
 
 }
+
+func TestFullBucket(t *testing.T) {
+	bucket := newBucket()
+	var contacts []Contact
+	for i := 0; i < bucketSize; i++ {
+		contact := NewContact(NewRandomKademliaID(), fmt.Sprintf("localhost:%d", 8000+i))
+		contacts = append(contacts, contact)
+		_, full := bucket.AddContact(contact)
+		assert.False(t, full)
+	}
+
+	// A newcomer waits in the replacement cache while the least recently
+	// seen contact is checked
+	newcomer := NewContact(NewRandomKademliaID(), "localhost:9000")
+	leastRecent, full := bucket.AddContact(newcomer)
+	assert.True(t, full)
+	assert.Equal(t, contacts[0], leastRecent)
+	assert.False(t, bucket.Contains(newcomer.ID))
+	assert.Equal(t, []Contact{newcomer}, bucket.Replacements())
+
+	// The contact answered, so the next one in line is checked next time
+	bucket.AddContact(leastRecent)
+	leastRecent, _ = bucket.AddContact(newcomer)
+	assert.Equal(t, contacts[1], leastRecent)
+	assert.Len(t, bucket.Replacements(), 1)
+
+	// It did not answer, the newcomer takes its place
+	bucket.RemoveContact(leastRecent)
+	assert.Equal(t, bucketSize, bucket.Len())
+	assert.True(t, bucket.Contains(newcomer.ID))
+	assert.False(t, bucket.Contains(leastRecent.ID))
+	assert.Empty(t, bucket.Replacements())
+
+	// The replacement cache keeps the most recently seen candidates
+	for i := 0; i < replacementCacheSize+5; i++ {
+		bucket.AddContact(NewContact(NewRandomKademliaID(), fmt.Sprintf("localhost:%d", 9100+i)))
+	}
+	replacements := bucket.Replacements()
+	assert.Len(t, replacements, replacementCacheSize)
+	assert.Equal(t, fmt.Sprintf("localhost:%d", 9100+replacementCacheSize+4), replacements[0].Address)
+}
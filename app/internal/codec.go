@@ -0,0 +1,467 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Codec turns an RPC into bytes for the wire and back
+type Codec interface {
+	Encode(rpc RPC) ([]byte, error)
+	Decode(data []byte) (RPC, error)
+}
+
+// JSONCodec is the original wire format, a JSON object per message
+type JSONCodec struct{}
+
+func (JSONCodec) Encode(rpc RPC) ([]byte, error) {
+	return json.Marshal(rpc)
+}
+
+func (JSONCodec) Decode(data []byte) (RPC, error) {
+	var rpc RPC
+	if err := json.Unmarshal(data, &rpc); err != nil {
+		return RPC{}, err
+	}
+	return rpc, nil
+}
+
+// Every binary message starts with this byte. JSON messages start with '{',
+// so a node can tell the two encodings apart and accept both while a
+// cluster is being upgraded.
+const binaryMagic byte = 0xB1
+
+// How the payload of a binary message is stored
+const (
+	payloadJSON   byte = 0 // Raw JSON, for payload types without a PayloadFormat
+	payloadBinary byte = 1
+	payloadSealed byte = 2 // Encrypted with a session, see RPC.Encrypted
+)
+
+var errTruncated = errors.New("binary message is truncated")
+
+// BinaryCodec is a compact length-prefixed encoding of an RPC and its payload.
+// IDs are written as their 20 raw bytes, strings and byte slices are prefixed
+// with their length, and the transient Contact.Distance is left out.
+//
+//	magic | version | capabilities | type | sender | rpc id | timestamp | public key | signature | payload kind | payload | [puzzle nonce | [mac]]
+//
+// The puzzle nonce is only written when the sender has one or the message
+// has a MAC, so nodes not using crypto puzzles or a private network send
+// exactly what they did before these were added.
+type BinaryCodec struct{}
+
+func (BinaryCodec) Encode(rpc RPC) ([]byte, error) {
+	w := &binaryWriter{}
+	w.buf.WriteByte(binaryMagic)
+	w.uvarint(uint64(rpc.Version))
+	w.uvarint(uint64(rpc.Capabilities))
+	w.string(rpc.Type)
+	w.contact(rpc.Sender)
+	w.id(rpc.RpcID)
+	w.uvarint(uint64(rpc.Timestamp))
+	w.bytes(rpc.PublicKey)
+	w.bytes(rpc.Signature)
+
+	kind, payload, err := encodePayload(rpc)
+	if err != nil {
+		return nil, err
+	}
+	w.buf.WriteByte(kind)
+	w.bytes(payload)
+	if rpc.PuzzleNonce != nil || rpc.MAC != nil {
+		w.id(rpc.PuzzleNonce)
+	}
+	if rpc.MAC != nil {
+		w.bytes(rpc.MAC)
+	}
+
+	return w.buf.Bytes(), nil
+}
+
+func (BinaryCodec) Decode(data []byte) (RPC, error) {
+	if len(data) == 0 || data[0] != binaryMagic {
+		return RPC{}, errors.New("not a binary message")
+	}
+
+	r := &binaryReader{data: data[1:]}
+	rpc := RPC{
+		Version:      uint16(r.uvarint()),
+		Capabilities: Capability(r.uvarint()),
+		Type:         r.string(),
+		Sender:       r.contact(),
+		RpcID:        r.id(),
+		Timestamp:    int64(r.uvarint()),
+	}
+	if publicKey := r.bytes(); publicKey != nil {
+		rpc.PublicKey = append(ed25519.PublicKey(nil), publicKey...)
+	}
+	if signature := r.bytes(); signature != nil {
+		rpc.Signature = append([]byte(nil), signature...)
+	}
+	kind := r.byte()
+	payload := r.bytes()
+	if len(r.data) > 0 {
+		rpc.PuzzleNonce = r.id()
+	}
+	if len(r.data) > 0 {
+		if mac := r.bytes(); mac != nil {
+			rpc.MAC = append([]byte(nil), mac...)
+		}
+	}
+	if r.err != nil {
+		return RPC{}, r.err
+	}
+
+	switch kind {
+	case payloadJSON:
+		if len(payload) > 0 {
+			// The payload points into the read buffer, which gets reused
+			rpc.Data = json.RawMessage(append([]byte(nil), payload...))
+		}
+	case payloadBinary:
+		decoded, err := decodePayload(rpc.Type, payload)
+		if err != nil {
+			return RPC{}, err
+		}
+		rpc.Data = decoded
+	case payloadSealed:
+		sealed, err := json.Marshal(payload)
+		if err != nil {
+			return RPC{}, err
+		}
+		rpc.Data = sealed
+		rpc.Encrypted = true
+	default:
+		return RPC{}, fmt.Errorf("unknown payload kind %d", kind)
+	}
+
+	return rpc, nil
+}
+
+// codecFor picks the codec a received message was encoded with
+func codecFor(data []byte) Codec {
+	if len(data) > 0 && data[0] == binaryMagic {
+		return BinaryCodec{}
+	}
+	return JSONCodec{}
+}
+
+type binaryWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *binaryWriter) uvarint(n uint64) {
+	var scratch [binary.MaxVarintLen64]byte
+	w.buf.Write(scratch[:binary.PutUvarint(scratch[:], n)])
+}
+
+func (w *binaryWriter) bytes(b []byte) {
+	w.uvarint(uint64(len(b)))
+	w.buf.Write(b)
+}
+
+func (w *binaryWriter) string(s string) {
+	w.bytes([]byte(s))
+}
+
+func (w *binaryWriter) id(id *KademliaID) {
+	if id == nil {
+		w.buf.WriteByte(0)
+		return
+	}
+	w.buf.WriteByte(1)
+	w.buf.Write(id[:])
+}
+
+func (w *binaryWriter) contact(contact Contact) {
+	w.id(contact.ID)
+	w.string(contact.Address)
+}
+
+func (w *binaryWriter) contacts(contacts []Contact) {
+	w.uvarint(uint64(len(contacts)))
+	for _, contact := range contacts {
+		w.contact(contact)
+	}
+}
+
+// encodePayload returns the payload of an RPC and how it is stored. Types
+// without a binary form are sent as raw JSON.
+func encodePayload(rpc RPC) (byte, []byte, error) {
+	if rpc.Encrypted {
+		// The sealed payload is a base64 string in JSON, here it is
+		// written as the raw bytes
+		var sealed []byte
+		err := json.Unmarshal(rpc.Data, &sealed)
+		return payloadSealed, sealed, err
+	}
+
+	format, found := lookupFormat(rpc.Type)
+	if !found {
+		return payloadJSON, rpc.Data, nil
+	}
+	payload, err := format.Encode(rpc.Data)
+	if err != nil {
+		return 0, nil, fmt.Errorf("unable to encode %s: %v", rpc.Type, err)
+	}
+	return payloadBinary, payload, nil
+}
+
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+	r.data = nil
+}
+
+func (r *binaryReader) byte() byte {
+	if len(r.data) < 1 {
+		r.fail(errTruncated)
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	n, size := binary.Uvarint(r.data)
+	if size <= 0 {
+		r.fail(errTruncated)
+		return 0
+	}
+	r.data = r.data[size:]
+	return n
+}
+
+func (r *binaryReader) bytes() []byte {
+	n := r.uvarint()
+	if uint64(len(r.data)) < n {
+		r.fail(errTruncated)
+		return nil
+	}
+	if n == 0 {
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+// optionalBytes reads a byte slice added to the end of a payload, which
+// messages from before it was added do not have
+func (r *binaryReader) optionalBytes() []byte {
+	if len(r.data) == 0 {
+		return nil
+	}
+	return r.bytes()
+}
+
+func (r *binaryReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *binaryReader) id() *KademliaID {
+	if r.byte() == 0 {
+		return nil
+	}
+	if len(r.data) < IDLength {
+		r.fail(errTruncated)
+		return nil
+	}
+	id := KademliaID{}
+	copy(id[:], r.data[:IDLength])
+	r.data = r.data[IDLength:]
+	return &id
+}
+
+func (r *binaryReader) contact() Contact {
+	id := r.id()
+	return Contact{ID: id, Address: r.string()}
+}
+
+func (r *binaryReader) contacts() []Contact {
+	n := r.uvarint()
+	if n > uint64(len(r.data)) {
+		r.fail(errTruncated)
+		return nil
+	}
+	var contacts []Contact
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		contacts = append(contacts, r.contact())
+	}
+	return contacts
+}
+
+// decodePayload reads a binary payload back into its JSON form, so the rest
+// of the node handles both encodings the same way.
+func decodePayload(rpcType string, payload []byte) (json.RawMessage, error) {
+	format, found := lookupFormat(rpcType)
+	if !found {
+		return nil, fmt.Errorf("no binary payload format for %s", rpcType)
+	}
+	return format.Decode(payload)
+}
+
+// binaryFormat makes the PayloadFormat of the payload type T from functions
+// writing and reading its fields
+func binaryFormat[T any](write func(w *binaryWriter, p T), read func(r *binaryReader) T) *PayloadFormat {
+	return &PayloadFormat{
+		Encode: func(data json.RawMessage) ([]byte, error) {
+			var p T
+			if err := json.Unmarshal(data, &p); err != nil {
+				return nil, err
+			}
+			w := &binaryWriter{}
+			write(w, p)
+			return w.buf.Bytes(), nil
+		},
+		Decode: func(payload []byte) (json.RawMessage, error) {
+			r := &binaryReader{data: payload}
+			p := read(r)
+			if r.err != nil {
+				return nil, r.err
+			}
+			return json.Marshal(p)
+		},
+	}
+}
+
+// Binary forms of the built-in payloads, registered with their RPCKind
+
+var pingRequestFormat = binaryFormat(
+	func(w *binaryWriter, p PingRequest) { w.id(p.PingID) },
+	func(r *binaryReader) PingRequest { return PingRequest{PingID: r.id()} },
+)
+
+var pingResponseFormat = binaryFormat(
+	func(w *binaryWriter, p PingResponse) { w.id(p.PongID) },
+	func(r *binaryReader) PingResponse { return PingResponse{PongID: r.id()} },
+)
+
+var findContactRequestFormat = binaryFormat(
+	func(w *binaryWriter, p FindContactRequest) { w.id(p.Target) },
+	func(r *binaryReader) FindContactRequest { return FindContactRequest{Target: r.id()} },
+)
+
+var findContactResponseFormat = binaryFormat(
+	func(w *binaryWriter, p FindContactResponse) {
+		w.contacts(p.Contacts)
+		w.bytes(p.Token)
+	},
+	func(r *binaryReader) FindContactResponse {
+		return FindContactResponse{Contacts: r.contacts(), Token: r.optionalBytes()}
+	},
+)
+
+var storeRequestFormat = binaryFormat(
+	func(w *binaryWriter, p StoreRequest) {
+		w.string(p.Key)
+		w.string(p.Data)
+		w.bytes(p.Token)
+	},
+	func(r *binaryReader) StoreRequest {
+		return StoreRequest{Key: r.string(), Data: r.string(), Token: r.optionalBytes()}
+	},
+)
+
+var storeResponseFormat = binaryFormat(
+	func(w *binaryWriter, p StoreResponse) { w.string(p.KeyLocation) },
+	func(r *binaryReader) StoreResponse { return StoreResponse{KeyLocation: r.string()} },
+)
+
+var findDataRequestFormat = binaryFormat(
+	func(w *binaryWriter, p FindDataRequest) { w.string(p.Hash) },
+	func(r *binaryReader) FindDataRequest { return FindDataRequest{Hash: r.string()} },
+)
+
+var findDataResponseFormat = binaryFormat(
+	func(w *binaryWriter, p FindDataResponse) {
+		w.contacts(p.Nodes)
+		w.bytes(p.Data)
+		w.bytes(p.Token)
+	},
+	func(r *binaryReader) FindDataResponse {
+		nodes := r.contacts()
+		data := r.bytes()
+		return FindDataResponse{Nodes: nodes, Data: data, Token: r.optionalBytes()}
+	},
+)
+
+var refreshRequestFormat = binaryFormat(
+	func(w *binaryWriter, p RefreshRequest) { w.string(p.Hash) },
+	func(r *binaryReader) RefreshRequest { return RefreshRequest{Hash: r.string()} },
+)
+
+var refreshResponseFormat = binaryFormat(
+	func(w *binaryWriter, p RefreshResponse) { w.contact(p.Node) },
+	func(r *binaryReader) RefreshResponse { return RefreshResponse{Node: r.contact()} },
+)
+
+var nodeInfoRequestFormat = binaryFormat(
+	func(w *binaryWriter, p NodeInfoRequest) {},
+	func(r *binaryReader) NodeInfoRequest { return NodeInfoRequest{} },
+)
+
+var nodeInfoResponseFormat = binaryFormat(
+	func(w *binaryWriter, p NodeInfoResponse) {
+		w.uvarint(uint64(p.Version))
+		w.uvarint(uint64(p.Capabilities))
+		w.uvarint(uint64(p.Uptime))
+	},
+	func(r *binaryReader) NodeInfoResponse {
+		return NodeInfoResponse{
+			Version:      uint16(r.uvarint()),
+			Capabilities: Capability(r.uvarint()),
+			Uptime:       time.Duration(r.uvarint()),
+		}
+	},
+)
+
+var handshakeRequestFormat = binaryFormat(
+	func(w *binaryWriter, p HandshakeRequest) { w.bytes(p.Key) },
+	func(r *binaryReader) HandshakeRequest { return HandshakeRequest{Key: r.bytes()} },
+)
+
+var handshakeResponseFormat = binaryFormat(
+	func(w *binaryWriter, p HandshakeResponse) { w.bytes(p.Key) },
+	func(r *binaryReader) HandshakeResponse { return HandshakeResponse{Key: r.bytes()} },
+)
+
+// Refusals answer requests of any kind, so they belong to none of them
+var refusalFormats = map[string]*PayloadFormat{
+	"UnsupportedResponse": binaryFormat(
+		func(w *binaryWriter, p UnsupportedResponse) {
+			w.string(p.RequestType)
+			w.uvarint(uint64(p.Version))
+			w.string(p.Reason)
+		},
+		func(r *binaryReader) UnsupportedResponse {
+			return UnsupportedResponse{
+				RequestType: r.string(),
+				Version:     uint16(r.uvarint()),
+				Reason:      r.string(),
+			}
+		},
+	),
+	"ErrorResponse": binaryFormat(
+		func(w *binaryWriter, p ErrorResponse) {
+			w.uvarint(uint64(p.Code))
+			w.string(p.Message)
+		},
+		func(r *binaryReader) ErrorResponse {
+			return ErrorResponse{Code: ErrorCode(r.uvarint()), Message: r.string()}
+		},
+	),
+}
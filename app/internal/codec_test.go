@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBinaryCodecRoundTrip(t *testing.T) {
+	sender := NewContact(NewRandomKademliaID(), "127.0.0.1:1337")
+	other := NewContact(NewRandomKademliaID(), "127.0.0.1:1338")
+	other.CalcDistance(sender.ID)
+
+	payloads := map[string]interface{}{
+		"PingRequest":         PingRequest{PingID: NewRandomKademliaID()},
+		"PingResponse":        PingResponse{PongID: NewRandomKademliaID()},
+		"FindContactRequest":  FindContactRequest{Target: NewRandomKademliaID()},
+		"FindContactResponse": FindContactResponse{Contacts: []Contact{sender, other}, Token: []byte{1, 2, 3}},
+		"StoreRequest":        StoreRequest{Key: "abc", Data: "Lagrar saker för testning", Token: []byte{1, 2, 3}},
+		"StoreResponse":       StoreResponse{KeyLocation: "abc"},
+		"FindDataRequest":     FindDataRequest{Hash: "abc"},
+		"FindDataResponse":    FindDataResponse{Data: []byte{0, 1, 2, 255}, Token: []byte{1, 2, 3}},
+		"RefreshRequest":      RefreshRequest{Hash: "abc"},
+		"RefreshResponse":     RefreshResponse{Node: other},
+		"NodeInfoRequest":     NodeInfoRequest{},
+		"NodeInfoResponse":    NodeInfoResponse{Version: 1, Capabilities: localCapabilities, Uptime: time.Minute},
+		"HandshakeRequest":    HandshakeRequest{Key: bytes.Repeat([]byte{7}, 32)},
+		"HandshakeResponse":   HandshakeResponse{Key: bytes.Repeat([]byte{9}, 32)},
+		"UnsupportedResponse": UnsupportedResponse{RequestType: "FooRequest", Version: 1, Reason: "unknown"},
+		"ErrorResponse":       ErrorResponse{Code: CodeNotFound, Message: "key was not found"},
+		"SomeFutureRequest":   map[string]int{"answer": 42},
+	}
+
+	for rpcType, payload := range payloads {
+		t.Run(rpcType, func(t *testing.T) {
+			data, _ := json.Marshal(payload)
+			rpc := RPC{Type: rpcType, Sender: sender, RpcID: NewRandomKademliaID(), Data: data}
+			stamp(&rpc)
+
+			encoded, err := BinaryCodec{}.Encode(rpc)
+			assert.NoError(t, err)
+			assert.Equal(t, binaryMagic, encoded[0])
+
+			// Only types we do not know travel as raw JSON
+			_, found := lookupFormat(rpcType)
+			assert.Equal(t, rpcType != "SomeFutureRequest", found)
+
+			decoded, err := DeserializeRPC(encoded)
+			assert.NoError(t, err)
+			assert.Equal(t, rpc.Type, decoded.Type)
+			assert.Equal(t, rpc.Sender, decoded.Sender)
+			assert.Equal(t, rpc.RpcID, decoded.RpcID)
+			assert.Equal(t, ProtocolVersion, decoded.Version)
+			assert.Equal(t, localCapabilities, decoded.Capabilities)
+
+			// Compare the payloads without the transient Distance field
+			expected, _ := json.Marshal(withoutDistance(t, rpcType, data))
+			actual, _ := json.Marshal(withoutDistance(t, rpcType, decoded.Data))
+			assert.JSONEq(t, string(expected), string(actual))
+		})
+	}
+}
+
+func withoutDistance(t *testing.T, rpcType string, data json.RawMessage) interface{} {
+	var payload map[string]interface{}
+	assert.NoError(t, json.Unmarshal(data, &payload))
+	for _, field := range []string{"Contacts", "Nodes"} {
+		if contacts, ok := payload[field].([]interface{}); ok {
+			for _, contact := range contacts {
+				delete(contact.(map[string]interface{}), "Distance")
+			}
+		}
+	}
+	if node, ok := payload["Node"].(map[string]interface{}); ok {
+		delete(node, "Distance")
+	}
+	return payload
+}
+
+func TestBinaryCodecIsSmaller(t *testing.T) {
+	contacts := make([]Contact, bucketSize)
+	for i := range contacts {
+		contacts[i] = NewContact(NewRandomKademliaID(), "172.20.0.10:1337")
+		contacts[i].CalcDistance(NewRandomKademliaID())
+	}
+	data, _ := json.Marshal(FindContactResponse{Contacts: contacts})
+	rpc := RPC{Type: "FindContactResponse", Sender: contacts[0], RpcID: NewRandomKademliaID(), Data: data}
+
+	jsonEncoded, _ := JSONCodec{}.Encode(rpc)
+	binaryEncoded, _ := BinaryCodec{}.Encode(rpc)
+	assert.Less(t, len(binaryEncoded)*3, len(jsonEncoded))
+}
+
+func TestBinaryCodecTruncated(t *testing.T) {
+	data, _ := json.Marshal(PingRequest{PingID: NewRandomKademliaID()})
+	encoded, _ := BinaryCodec{}.Encode(RPC{Type: "PingRequest", RpcID: NewRandomKademliaID(), Data: data})
+
+	for i := 1; i < len(encoded); i++ {
+		_, err := DeserializeRPC(encoded[:i])
+		assert.Error(t, err)
+	}
+}
+
+func TestMixedEncodings(t *testing.T) {
+	switchboard := NewSwitchboard()
+	jsonNode := startMemoryNode(t, switchboard, "10.0.0.1:1337")
+	binaryNode := startMemoryNode(t, switchboard, "10.0.0.2:1337")
+	(&Network{Node: binaryNode}).SetCodec(BinaryCodec{})
+
+	// Both nodes understand each other while only one of them sends binary
+	_, err := (&Network{Node: binaryNode}).SendPingMessage(&jsonNode.Self)
+	assert.NoError(t, err)
+	_, err = (&Network{Node: jsonNode}).SendPingMessage(&binaryNode.Self)
+	assert.NoError(t, err)
+
+	hash, err := binaryNode.Store(context.Background(), []byte("Lagrar binära saker"))
+	assert.NoError(t, err)
+	_, retrievedData, _ := jsonNode.Lookup(context.Background(), hash)
+	assert.Equal(t, []byte("Lagrar binära saker"), retrievedData)
+}
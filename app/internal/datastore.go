@@ -2,6 +2,7 @@ package internal
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"sync"
 	"time"
@@ -9,9 +10,23 @@ import (
 
 const TTL_AMOUNT = 10
 
+// Largest value a node accepts by default, in bytes
+const DefaultMaxValueSize = 64 * 1024
+
+var (
+	ErrValueTooLarge = errors.New("value exceeds the maximum value size")
+	ErrKeyNotFound   = errors.New("key was not found")
+)
+
+// Datastore holds the values stored on the node. The request handlers, the
+// API and the refresh loops use it at once, so Store is only touched with
+// mu held; the fields of an entry are guarded by the entry's own mutex. TTL
+// and MaxValueSize are set up before the node starts.
 type Datastore struct {
-	Store map[string]*DataEntry
-	TTL   time.Duration // U1.
+	Store        map[string]*DataEntry
+	TTL          time.Duration // U1.
+	MaxValueSize int
+	mu           sync.RWMutex
 }
 
 type DataEntry struct {
@@ -25,6 +40,7 @@ func NewDataStore() *Datastore {
 	DS := &Datastore{}
 	DS.Store = make(map[string]*DataEntry)
 	DS.TTL = TTL_AMOUNT * time.Second
+	DS.MaxValueSize = DefaultMaxValueSize
 
 	return DS
 }
@@ -35,24 +51,47 @@ func (DS *Datastore) putData(key string, data []byte) {
 		Time:   DS.getExpirationTime(),
 		Forget: false,
 	}
+	DS.mu.Lock()
+	defer DS.mu.Unlock()
+
 	DS.Store[key] = entry
 }
 
-func (DS *Datastore) getData(key string) (val []byte, hasVal bool) {
+// entry returns the entry for key, if there is one
+func (DS *Datastore) entry(key string) (*DataEntry, bool) {
+	DS.mu.RLock()
+	defer DS.mu.RUnlock()
+
 	entry, found := DS.Store[key]
-	if found {
-		entry.mu.Lock()
-		defer entry.mu.Unlock()
+	return entry, found
+}
 
-		if time.Now().After(entry.Time) {
-			log.Printf("Data is expired: %v", key)
-			delete(DS.Store, key)
-			return nil, false
-		}
+func (DS *Datastore) getData(key string) (val []byte, hasVal bool) {
+	entry, found := DS.entry(key)
+	if !found {
+		return nil, false
+	}
 
-		return entry.Data, true
+	entry.mu.Lock()
+	data, expired := entry.Data, time.Now().After(entry.Time)
+	entry.mu.Unlock()
+
+	if expired {
+		log.Printf("Data is expired: %v", key)
+		DS.remove(key, entry)
+		return nil, false
+	}
+	return data, true
+}
+
+// remove deletes the entry for key, unless it was replaced in the meantime
+func (DS *Datastore) remove(key string, entry *DataEntry) {
+	DS.mu.Lock()
+	defer DS.mu.Unlock()
+
+	if DS.Store[key] == entry {
+		delete(DS.Store, key)
 	}
-	return nil, false
 }
 
 func (DS *Datastore) getExpirationTime() (expirationTime time.Time) {
@@ -61,9 +100,9 @@ func (DS *Datastore) getExpirationTime() (expirationTime time.Time) {
 
 // U2.
 func (DS *Datastore) refreshData(key string) error {
-	entry, found := DS.Store[key]
+	entry, found := DS.entry(key)
 	if !found {
-		return errors.New("refreshData: key was not found")
+		return fmt.Errorf("refreshData: %w", ErrKeyNotFound)
 	}
 
 	entry.mu.Lock()
@@ -78,9 +117,9 @@ func (DS *Datastore) refreshData(key string) error {
 func (DS *Datastore) toggleForgetFlag(key string) error {
 	log.Printf("Check hash %v", key)
 
-	entry, found := DS.Store[key]
+	entry, found := DS.entry(key)
 	if !found {
-		return errors.New("toggleForgetFlag: key was not found")
+		return fmt.Errorf("toggleForgetFlag: %w", ErrKeyNotFound)
 	}
 
 	entry.mu.Lock()
@@ -93,7 +132,7 @@ func (DS *Datastore) toggleForgetFlag(key string) error {
 
 // U3.
 func (DS *Datastore) checkForgetFlag(key string) bool {
-	entry, found := DS.Store[key]
+	entry, found := DS.entry(key)
 	if !found {
 		return false
 	}
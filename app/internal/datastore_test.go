@@ -1,6 +1,8 @@
 package internal
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -25,3 +27,27 @@ func TestDatastore(t *testing.T) {
 	_, exists = datastore.getData(nonExistentKey)
 	assert.False(t, exists, "Expected non-existent key to not exist in the datastore")
 }
+
+func TestDatastoreConcurrentUse(t *testing.T) {
+	datastore := NewDataStore()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				key := fmt.Sprintf("key%d", j%10)
+				datastore.putData(key, []byte(fmt.Sprintf("data%d", i)))
+				datastore.getData(key)
+				datastore.refreshData(key)
+				datastore.toggleForgetFlag(key)
+				datastore.checkForgetFlag(key)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	_, found := datastore.getData("key0")
+	assert.True(t, found)
+}
@@ -0,0 +1,331 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// errNoSession is answered to encrypted requests from peers we have no
+// session with, e.g. because we restarted since the handshake
+var errNoSession = &RemoteError{Code: CodeNoSession, Message: "no session, handshake again"}
+
+// Sessions kept at most, and how long one is kept without being used. A peer
+// whose session was dropped is answered with CodeNoSession and handshakes
+// again.
+const (
+	maxSessions        = 4096
+	sessionIdleTimeout = 30 * time.Minute
+)
+
+// session is the shared key of this node and one peer. Both sides derive the
+// same key from the handshake, so it is used in both directions.
+type session struct {
+	peer     KademliaID
+	aead     cipher.AEAD
+	lastUsed time.Time // Guarded by sessionSettings.mu
+}
+
+// sessionSettings holds the key exchange key of the node and the sessions
+// agreed with its peers. The key exchange key only lives as long as the
+// process; it is bound to the node identity by the signature on the
+// handshake it is sent in.
+type sessionSettings struct {
+	mu        sync.Mutex
+	enabled   bool
+	key       *ecdh.PrivateKey
+	sessions  map[KademliaID]*session
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newSessionSettings() *sessionSettings {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	mustRandom(err)
+	return &sessionSettings{
+		key:       key,
+		sessions:  make(map[KademliaID]*session),
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// SetEncryption turns encryption of the requests this node sends on or off.
+// The first request to a peer is preceded by a handshake, later ones reuse
+// the session. Encrypted requests from others are answered either way.
+func (network *Network) SetEncryption(enabled bool) {
+	settings := network.Node.sessions
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+
+	settings.enabled = enabled
+}
+
+// Encryption reports whether the requests this node sends are encrypted
+func (network *Network) Encryption() bool {
+	settings := network.Node.sessions
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+
+	return settings.enabled
+}
+
+func (settings *sessionSettings) lookup(peer *KademliaID) (*session, bool) {
+	if peer == nil {
+		return nil, false
+	}
+
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+
+	now := settings.now()
+	settings.sweep(now)
+
+	s, found := settings.sessions[*peer]
+	if !found || now.Sub(s.lastUsed) >= sessionIdleTimeout {
+		delete(settings.sessions, *peer)
+		return nil, false
+	}
+	s.lastUsed = now
+	return s, true
+}
+
+func (settings *sessionSettings) forget(peer KademliaID) {
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+
+	delete(settings.sessions, peer)
+}
+
+// agree derives the session with a peer from its key exchange key
+func (settings *sessionSettings) agree(self *KademliaID, peer *KademliaID, peerKey []byte) (*session, error) {
+	publicKey, err := ecdh.X25519().NewPublicKey(peerKey)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := settings.key.ECDH(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Both IDs go into the key, in the same order on both sides
+	first, second := self, peer
+	if peer.Less(self) {
+		first, second = peer, self
+	}
+	hash := sha256.New()
+	hash.Write([]byte("kademlia session"))
+	hash.Write(secret)
+	hash.Write(first[:])
+	hash.Write(second[:])
+
+	block, err := aes.NewCipher(hash.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+
+	s := &session{peer: *peer, aead: aead, lastUsed: settings.now()}
+	settings.add(s)
+	return s, nil
+}
+
+// add keeps a new session. When there are maxSessions already, the least
+// recently used one makes room. The caller holds mu.
+func (settings *sessionSettings) add(s *session) {
+	settings.sweep(s.lastUsed)
+
+	if _, found := settings.sessions[s.peer]; !found && len(settings.sessions) >= maxSessions {
+		var oldest *session
+		for _, other := range settings.sessions {
+			if oldest == nil || other.lastUsed.Before(oldest.lastUsed) {
+				oldest = other
+			}
+		}
+		delete(settings.sessions, oldest.peer)
+	}
+	settings.sessions[s.peer] = s
+}
+
+// sweep forgets the sessions that were not used for sessionIdleTimeout, so
+// peers that went away take no memory. The caller holds mu.
+func (settings *sessionSettings) sweep(now time.Time) {
+	if now.Sub(settings.lastSweep) < sweepInterval {
+		return
+	}
+	settings.lastSweep = now
+
+	for peer, s := range settings.sessions {
+		if now.Sub(s.lastUsed) >= sessionIdleTimeout {
+			delete(settings.sessions, peer)
+		}
+	}
+}
+
+func handleHandshake(network *Network, request RPC) (interface{}, error) {
+	var handshakeReq HandshakeRequest
+	if err := json.Unmarshal(request.Data, &handshakeReq); err != nil {
+		return nil, badRequest(err)
+	}
+
+	sessions := network.Node.sessions
+	if _, err := sessions.agree(network.Node.Self.ID, request.Sender.ID, handshakeReq.Key); err != nil {
+		return nil, badRequest(err)
+	}
+	return HandshakeResponse{Key: sessions.key.PublicKey().Bytes()}, nil
+}
+
+// handshake agrees on a session with contact
+func (network *Network) handshake(contact *Contact) (*session, error) {
+	sessions := network.Node.sessions
+	requestData, err := json.Marshal(HandshakeRequest{Key: sessions.key.PublicKey().Bytes()})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrEncode, err)
+	}
+
+	request := RPC{
+		Type:   "HandshakeRequest",
+		Sender: network.Node.Self,
+		RpcID:  NewRandomKademliaID(),
+		Data:   json.RawMessage(requestData),
+	}
+	response, err := network.exchange(contact, request)
+	if err != nil {
+		return nil, err
+	}
+	if !Validate(request, response) {
+		return nil, fmt.Errorf("%w: %s does not answer HandshakeRequest", ErrBadResponse, response.Type)
+	}
+
+	var handshakeResp HandshakeResponse
+	if err := json.Unmarshal(response.Data, &handshakeResp); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadResponse, err)
+	}
+
+	// The session belongs to whoever signed the response, which is not
+	// necessarily the ID we had for the contact
+	s, err := sessions.agree(network.Node.Self.ID, response.Sender.ID, handshakeResp.Key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadResponse, err)
+	}
+	return s, nil
+}
+
+// sendEncrypted sends a request inside the session with contact, doing the
+// handshake first if there is none yet. A peer that lost the session is
+// given one new handshake.
+func (network *Network) sendEncrypted(contact *Contact, request RPC) (RPC, error) {
+	sessions := network.Node.sessions
+
+	for attempt := 0; ; attempt++ {
+		s, found := sessions.lookup(contact.ID)
+		if !found {
+			var err error
+			if s, err = network.handshake(contact); err != nil {
+				return RPC{}, err
+			}
+		}
+
+		sealed, err := s.seal(request)
+		if err != nil {
+			return RPC{}, fmt.Errorf("%w: %v", ErrEncode, err)
+		}
+
+		response, err := network.exchange(contact, sealed)
+		var remoteErr *RemoteError
+		if errors.As(err, &remoteErr) && remoteErr.Code == CodeNoSession && attempt == 0 {
+			sessions.forget(s.peer)
+			continue
+		}
+		if err != nil {
+			return response, err
+		}
+
+		if !response.Encrypted {
+			return RPC{}, fmt.Errorf("%w: %s to an encrypted request is not encrypted", ErrBadResponse, response.Type)
+		}
+		response, err = s.open(response)
+		if err != nil {
+			return RPC{}, fmt.Errorf("%w: %v", ErrBadResponse, err)
+		}
+		return response, nil
+	}
+}
+
+// openRequest decrypts an incoming request and returns the session to
+// encrypt the response with. Plaintext requests are returned as they are.
+func (network *Network) openRequest(request RPC) (RPC, *session, error) {
+	if !request.Encrypted {
+		return request, nil, nil
+	}
+
+	s, found := network.Node.sessions.lookup(request.Sender.ID)
+	if !found {
+		return request, nil, errNoSession
+	}
+	opened, err := s.open(request)
+	if err != nil {
+		return request, nil, badRequest(err)
+	}
+	return opened, s, nil
+}
+
+// seal encrypts the payload of an RPC. The type and RpcID are left readable
+// for routing the response, but are authenticated along with the payload.
+func (s *session) seal(rpc RPC) (RPC, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return RPC{}, err
+	}
+
+	sealed := s.aead.Seal(nonce, nonce, rpc.Data, additionalData(rpc))
+	data, err := json.Marshal(sealed)
+	if err != nil {
+		return RPC{}, err
+	}
+	rpc.Data = data
+	rpc.Encrypted = true
+	return rpc, nil
+}
+
+func (s *session) open(rpc RPC) (RPC, error) {
+	var sealed []byte
+	if err := json.Unmarshal(rpc.Data, &sealed); err != nil {
+		return RPC{}, err
+	}
+	if len(sealed) < s.aead.NonceSize() {
+		return RPC{}, errors.New("encrypted payload is truncated")
+	}
+
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	data, err := s.aead.Open(nil, nonce, ciphertext, additionalData(rpc))
+	if err != nil {
+		return RPC{}, err
+	}
+	rpc.Data = data
+	rpc.Encrypted = false
+	return rpc, nil
+}
+
+func additionalData(rpc RPC) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(rpc.Type)
+	if rpc.RpcID != nil {
+		buf.Write(rpc.RpcID[:])
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionSealAndOpen(t *testing.T) {
+	first := NewKademliaNode("127.0.0.1:1337")
+	second := NewKademliaNode("127.0.0.1:1338")
+
+	// Both sides derive the same session from each other's keys
+	firstSession, err := first.sessions.agree(first.Self.ID, second.Self.ID, second.sessions.key.PublicKey().Bytes())
+	assert.NoError(t, err)
+	secondSession, err := second.sessions.agree(second.Self.ID, first.Self.ID, first.sessions.key.PublicKey().Bytes())
+	assert.NoError(t, err)
+
+	storeData, _ := json.Marshal(StoreRequest{Key: "abc", Data: "Hemliga saker"})
+	rpc := RPC{Type: "StoreRequest", Sender: first.Self, RpcID: NewRandomKademliaID(), Data: storeData}
+	sealed, err := firstSession.seal(rpc)
+	assert.NoError(t, err)
+	assert.True(t, sealed.Encrypted)
+	assert.False(t, bytes.Contains(sealed.Data, []byte("Hemliga")))
+
+	// The sealed payload survives both codecs and the signature holds
+	stamp(&sealed)
+	assert.NoError(t, (&Network{Node: &first}).sign(&sealed))
+	for _, codec := range []Codec{JSONCodec{}, BinaryCodec{}} {
+		encoded, err := codec.Encode(sealed)
+		assert.NoError(t, err)
+		decoded, err := codec.Decode(encoded)
+		assert.NoError(t, err)
+		assert.NoError(t, verify(decoded))
+
+		opened, err := secondSession.open(decoded)
+		assert.NoError(t, err)
+		assert.JSONEq(t, string(storeData), string(opened.Data))
+	}
+
+	// The type is authenticated along with the payload
+	sealed.Type = "FindDataRequest"
+	_, err = secondSession.open(sealed)
+	assert.Error(t, err)
+}
+
+func TestEncryptedNetwork(t *testing.T) {
+	switchboard := NewSwitchboard()
+	bootstrap := startMemoryNode(t, switchboard, "10.4.0.1:1337")
+	nodes := []*Kademlia{bootstrap}
+	for _, address := range []string{"10.4.0.2:1337", "10.4.0.3:1337", "10.4.0.4:1337"} {
+		node := startMemoryNode(t, switchboard, address)
+		(&Network{Node: node}).SetEncryption(true)
+		node.JoinNetwork(context.Background(), &bootstrap.Self)
+		nodes = append(nodes, node)
+	}
+
+	dataToStore := []byte("Lagrar hemliga saker")
+	hash, err := nodes[1].Store(context.Background(), dataToStore)
+	assert.NoError(t, err)
+	_, retrievedData, _ := nodes[3].Lookup(context.Background(), hash)
+	assert.Equal(t, dataToStore, retrievedData)
+
+	// The session is set up once and reused
+	network := &Network{Node: nodes[1]}
+	_, err = network.SendPingMessage(&bootstrap.Self)
+	assert.NoError(t, err)
+	session, found := nodes[1].sessions.lookup(bootstrap.Self.ID)
+	assert.True(t, found)
+	_, err = network.SendPingMessage(&bootstrap.Self)
+	assert.NoError(t, err)
+	again, _ := nodes[1].sessions.lookup(bootstrap.Self.ID)
+	assert.Same(t, session, again)
+
+	// A peer that lost the session makes us do the handshake again
+	bootstrap.sessions.forget(*nodes[1].Self.ID)
+	_, err = network.SendPingMessage(&bootstrap.Self)
+	assert.NoError(t, err)
+	renewed, _ := nodes[1].sessions.lookup(bootstrap.Self.ID)
+	assert.NotSame(t, session, renewed)
+}
+
+func TestEncryptedRequestWithoutSession(t *testing.T) {
+	node := NewKademliaNode("127.0.0.1:1337")
+	stranger := NewKademliaNode("127.0.0.1:1338")
+	network := &Network{Node: &node}
+
+	request := RPC{Type: "PingRequest", Sender: stranger.Self, RpcID: NewRandomKademliaID(), Encrypted: true}
+	_, _, err := network.openRequest(request)
+	assert.Equal(t, CodeNoSession, errorCode(err))
+}
+
+func TestSessionsExpireAndAreBounded(t *testing.T) {
+	settings := newSessionSettings()
+	now := time.Now()
+	settings.now = func() time.Time { return now }
+
+	self, peer := NewRandomKademliaID(), NewRandomKademliaID()
+	_, err := settings.agree(self, peer, newSessionSettings().key.PublicKey().Bytes())
+	assert.NoError(t, err)
+
+	// A session in use is kept, an idle one is dropped
+	now = now.Add(sessionIdleTimeout - time.Minute)
+	_, found := settings.lookup(peer)
+	assert.True(t, found)
+	now = now.Add(sessionIdleTimeout - time.Minute)
+	_, found = settings.lookup(peer)
+	assert.True(t, found)
+	now = now.Add(sessionIdleTimeout)
+	_, found = settings.lookup(peer)
+	assert.False(t, found)
+
+	// A full table makes room by dropping the least recently used session
+	settings.mu.Lock()
+	var oldest, newest KademliaID
+	for i := 0; i <= maxSessions; i++ {
+		s := &session{peer: *NewRandomKademliaID(), lastUsed: now.Add(time.Duration(i) * time.Millisecond)}
+		settings.add(s)
+		if i == 0 {
+			oldest = s.peer
+		}
+		newest = s.peer
+	}
+	assert.Len(t, settings.sessions, maxSessions)
+	settings.mu.Unlock()
+	_, found = settings.lookup(&oldest)
+	assert.False(t, found)
+	_, found = settings.lookup(&newest)
+	assert.True(t, found)
+
+	// Idle sessions are swept without anyone asking for them
+	now = now.Add(sessionIdleTimeout + time.Minute)
+	settings.lookup(self)
+	settings.mu.Lock()
+	assert.Empty(t, settings.sessions)
+	settings.mu.Unlock()
+}
@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// endpoint is the single transport a node uses both for serving incoming
+// requests and for sending its own. Responses arrive on the listening
+// transport and are routed to the waiting caller through the pending table,
+// which is keyed by the RpcID of the request.
+type endpoint struct {
+	transport   Transport
+	ready       chan struct{} // closed once the transport has been bound by Serve
+	mu          sync.Mutex
+	pending     map[KademliaID]chan RPC
+	reassembler *reassembler
+	codec       Codec // Encoding used for the requests we send
+}
+
+func newEndpoint() *endpoint {
+	return &endpoint{
+		ready:       make(chan struct{}),
+		pending:     make(map[KademliaID]chan RPC),
+		reassembler: newReassembler(),
+		codec:       JSONCodec{},
+	}
+}
+
+// bind attaches the listening transport to the endpoint. A node only ever
+// has one transport, so binding twice is an error.
+func (ep *endpoint) bind(transport Transport) error {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	if ep.transport != nil {
+		return errors.New("endpoint is already bound")
+	}
+	ep.transport = transport
+	close(ep.ready)
+	return nil
+}
+
+// waitReady blocks until Serve has bound the transport or the timeout passes.
+func (ep *endpoint) waitReady(timeout time.Duration) (Transport, error) {
+	select {
+	case <-ep.ready:
+		return ep.transport, nil
+	case <-time.After(timeout):
+		return nil, ErrNotListening
+	}
+}
+
+// register adds a pending request and returns the channel its response will
+// be delivered on.
+func (ep *endpoint) register(rpcID *KademliaID) chan RPC {
+	ch := make(chan RPC, 1)
+
+	ep.mu.Lock()
+	ep.pending[*rpcID] = ch
+	ep.mu.Unlock()
+
+	return ch
+}
+
+func (ep *endpoint) unregister(rpcID *KademliaID) {
+	ep.mu.Lock()
+	delete(ep.pending, *rpcID)
+	ep.mu.Unlock()
+}
+
+// deliver hands a response to the caller waiting on its RpcID. Responses
+// nobody is waiting for (late or duplicated) are dropped.
+func (ep *endpoint) deliver(response RPC) bool {
+	if response.RpcID == nil {
+		return false
+	}
+
+	ep.mu.Lock()
+	ch, found := ep.pending[*response.RpcID]
+	delete(ep.pending, *response.RpcID)
+	ep.mu.Unlock()
+
+	if !found {
+		return false
+	}
+	ch <- response
+	return true
+}
+
+// isResponse reports whether the RPC answers an earlier request
+func isResponse(rpc RPC) bool {
+	return strings.HasSuffix(rpc.Type, "Response")
+}
@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// Errors returned by the Network send methods. They are wrapped with details
+// about the failed request, so compare them with errors.Is.
+var (
+	ErrEncode       = errors.New("unable to encode request")
+	ErrSendFailed   = errors.New("unable to send request")
+	ErrNotListening = errors.New("node is not listening")
+	ErrTimeout      = errors.New("timeout while waiting for response")
+	ErrBadResponse  = errors.New("bad response")
+	ErrNodeClosed   = errors.New("node is closed")
+
+	// ErrRemote matches every RemoteError, use errors.As to get its code
+	ErrRemote = errors.New("remote error")
+)
+
+// ErrorCode tells the requesting node why its request failed
+type ErrorCode uint16
+
+const (
+	CodeInternal      ErrorCode = iota + 1 // The handler failed for a reason of its own
+	CodeBadRequest                         // The request payload could not be parsed
+	CodeNotFound                           // The requested key is not stored on the node
+	CodeValueTooLarge                      // The value exceeds the node's maximum value size
+	CodeUnsupported                        // The request type or protocol version is not understood
+	CodeNoSession                          // The request is encrypted, but there is no session with the sender
+	CodeBadToken                           // The StoreRequest has no valid token for the sender
+)
+
+func (code ErrorCode) String() string {
+	switch code {
+	case CodeInternal:
+		return "internal error"
+	case CodeBadRequest:
+		return "bad request"
+	case CodeNotFound:
+		return "not found"
+	case CodeValueTooLarge:
+		return "value too large"
+	case CodeUnsupported:
+		return "unsupported"
+	case CodeNoSession:
+		return "no session"
+	case CodeBadToken:
+		return "bad token"
+	default:
+		return fmt.Sprintf("error %d", uint16(code))
+	}
+}
+
+// ErrorResponse is sent back instead of the regular response when the
+// handler for a request fails
+type ErrorResponse struct {
+	Code    ErrorCode
+	Message string
+}
+
+// RemoteError is the Go error for an ErrorResponse or UnsupportedResponse
+// received from a peer. The peer answered, so it is alive and healthy even
+// though the request failed.
+type RemoteError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (err *RemoteError) Error() string {
+	return fmt.Sprintf("remote error (%v): %s", err.Code, err.Message)
+}
+
+// Is makes errors.Is(err, ErrRemote) hold for every RemoteError
+func (err *RemoteError) Is(target error) bool {
+	return target == ErrRemote
+}
+
+// badRequest marks an error as caused by a malformed request
+func badRequest(err error) error {
+	return &RemoteError{Code: CodeBadRequest, Message: err.Error()}
+}
+
+// errorCode picks the code an ErrorResponse is sent with for a handler error
+func errorCode(err error) ErrorCode {
+	var remoteErr *RemoteError
+	switch {
+	case errors.As(err, &remoteErr):
+		return remoteErr.Code
+	case errors.Is(err, ErrKeyNotFound):
+		return CodeNotFound
+	case errors.Is(err, ErrValueTooLarge):
+		return CodeValueTooLarge
+	default:
+		return CodeInternal
+	}
+}
+
+func (network *Network) createErrorResponse(request RPC, handlerErr error) (RPC, error) {
+	errorResponse := ErrorResponse{
+		Code:    errorCode(handlerErr),
+		Message: handlerErr.Error(),
+	}
+
+	responseData, err := json.Marshal(errorResponse)
+	if err != nil {
+		log.Printf("Error marshaling ErrorResponse: %v", err)
+		return RPC{}, err
+	}
+
+	return RPC{
+		Sender: network.Node.Self,
+		Type:   "ErrorResponse",
+		Data:   json.RawMessage(responseData),
+		RpcID:  request.RpcID,
+	}, nil
+}
+
+// isRefusal tells whether a response is an ErrorResponse or
+// UnsupportedResponse rather than the regular response to a request
+func isRefusal(response RPC) bool {
+	return response.Type == "ErrorResponse" || response.Type == "UnsupportedResponse"
+}
+
+// remoteError returns the error carried by a refusal from the peer, or nil
+// if the response is a regular one
+func remoteError(response RPC) error {
+	switch response.Type {
+	case "ErrorResponse":
+		var errorResponse ErrorResponse
+		if err := json.Unmarshal(response.Data, &errorResponse); err != nil {
+			return fmt.Errorf("%w: %v", ErrBadResponse, err)
+		}
+		return &RemoteError{Code: errorResponse.Code, Message: errorResponse.Message}
+
+	case "UnsupportedResponse":
+		var unsupportedResponse UnsupportedResponse
+		if err := json.Unmarshal(response.Data, &unsupportedResponse); err != nil {
+			return fmt.Errorf("%w: %v", ErrBadResponse, err)
+		}
+		return &RemoteError{
+			Code: CodeUnsupported,
+			Message: fmt.Sprintf("%s not supported by peer (version %d): %s",
+				unsupportedResponse.RequestType, unsupportedResponse.Version, unsupportedResponse.Reason),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package internal
+
+import (
+	"context"
+)
+
+// addContact puts a contact we heard from into the routing table. When its
+// bucket is full, the least recently seen contact of the bucket is queued to
+// be pinged by checkEvictions.
+func (network *Network) addContact(contact Contact) {
+	leastRecent, full := network.Node.Routes.AddContact(contact)
+	if full {
+		network.Node.evictions.add(leastRecent)
+	}
+}
+
+// checkEvictions pings the least recently seen contacts of full buckets
+// until ctx is done. A contact that answers is moved to the front of its
+// bucket by HandleResponseRPC. One that does not has the failure counted
+// like for any other request, and is only evicted once it failed as often
+// as SetMaxFailures allows. Then the newest contact of the bucket's
+// replacement cache takes its place, until then the newcomer waits there.
+func (network *Network) checkEvictions(ctx context.Context) {
+	evictions := network.Node.evictions
+	for {
+		select {
+		case contact := <-evictions.queue:
+			network.SendPingMessage(&contact)
+			evictions.done(contact)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startNodeInBucket starts a node that falls into the bucket of node's
+// routing table with the given index
+func startNodeInBucket(t *testing.T, switchboard *Switchboard, node *Kademlia, index int, address string) *Kademlia {
+	for {
+		identity, err := GenerateIdentity(PuzzleDifficulty{})
+		assert.NoError(t, err)
+		if node.Routes.getBucketIndex(identity.ID()) != index {
+			continue
+		}
+
+		other := NewKademliaNodeWithIdentity(address, identity)
+		transport, err := switchboard.Listen(address)
+		assert.NoError(t, err)
+		go (&Network{Node: &other}).Serve(context.Background(), transport)
+		t.Cleanup(func() { other.Close() })
+		return &other
+	}
+}
+
+// bucketContacts returns the contacts in a bucket, most recently seen first
+func bucketContacts(rt *RoutingTable, index int) []Contact {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	return rt.buckets[index].GetContactAndCalcDistance(rt.me.ID)
+}
+
+func TestPingBeforeEvict(t *testing.T) {
+	switchboard := NewSwitchboard()
+	node := startMemoryNode(t, switchboard, "10.10.0.1:1337")
+	network := &Network{Node: node}
+	network.SetRetryPolicy("PingRequest", RetryPolicy{Timeout: 50 * time.Millisecond})
+	network.SetMaxFailures(1)
+
+	// The least recently seen contact of the first bucket is alive, the
+	// others do not answer
+	keeper := startNodeInBucket(t, switchboard, node, 0, "10.10.0.2:1337")
+	node.Routes.AddContact(keeper.Self)
+	for i := 1; i < bucketSize; i++ {
+		id := *node.Self.ID
+		id[0] ^= 0x80
+		id[IDLength-1] = byte(i)
+		node.Routes.AddContact(NewContact(&id, fmt.Sprintf("10.10.1.%d:1337", i)))
+	}
+	contacts := bucketContacts(node.Routes, 0)
+	assert.Equal(t, keeper.Self.ID, contacts[bucketSize-1].ID)
+
+	// A newcomer has to wait while the keeper answers
+	newcomer := startNodeInBucket(t, switchboard, node, 0, "10.10.0.3:1337")
+	_, err := (&Network{Node: newcomer}).SendPingMessage(&node.Self)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return bucketContacts(node.Routes, 0)[0].ID.Equals(keeper.Self.ID)
+	}, time.Second, 10*time.Millisecond)
+	assert.False(t, node.Routes.Contains(newcomer.Self.ID))
+	assert.Len(t, node.Routes.Replacements(newcomer.Self.ID), 1)
+
+	// The next one in line is dead, so the newcomer takes its place
+	dead := bucketContacts(node.Routes, 0)[bucketSize-1]
+	_, err = (&Network{Node: newcomer}).SendPingMessage(&node.Self)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return node.Routes.Contains(newcomer.Self.ID)
+	}, time.Second, 10*time.Millisecond)
+	assert.False(t, node.Routes.Contains(dead.ID))
+	assert.True(t, node.Routes.Contains(keeper.Self.ID))
+	assert.Len(t, bucketContacts(node.Routes, 0), bucketSize)
+}
+
+func TestEvictOnlyAfterMaxFailures(t *testing.T) {
+	switchboard := NewSwitchboard()
+	node := startMemoryNode(t, switchboard, "10.10.2.1:1337")
+	network := &Network{Node: node}
+	network.SetRetryPolicy("PingRequest", RetryPolicy{Timeout: 50 * time.Millisecond})
+	network.SetMaxFailures(2)
+
+	// Nobody in the first bucket answers
+	for i := 0; i < bucketSize; i++ {
+		id := *node.Self.ID
+		id[0] ^= 0x80
+		id[IDLength-1] = byte(i)
+		node.Routes.AddContact(NewContact(&id, fmt.Sprintf("10.10.3.%d:1337", i)))
+	}
+	dead := bucketContacts(node.Routes, 0)[bucketSize-1]
+
+	// One lost ping is not enough to evict the dead contact
+	first := startNodeInBucket(t, switchboard, node, 0, "10.10.2.2:1337")
+	_, err := (&Network{Node: first}).SendPingMessage(&node.Self)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		health, _ := node.Routes.Health(dead.ID)
+		return health.Failures == 1
+	}, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, node.Routes.Contains(dead.ID))
+	assert.False(t, node.Routes.Contains(first.Self.ID))
+	assert.Len(t, node.Routes.Replacements(first.Self.ID), 1)
+
+	// The second one is, and the newcomer takes its place
+	_, err = (&Network{Node: first}).SendPingMessage(&node.Self)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return node.Routes.Contains(first.Self.ID)
+	}, time.Second, 10*time.Millisecond)
+	assert.False(t, node.Routes.Contains(dead.ID))
+	assert.Len(t, bucketContacts(node.Routes, 0), bucketSize)
+}
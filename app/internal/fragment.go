@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Messages that do not fit in one datagram are split into fragments. Every
+// fragment starts with a header so the receiver can put the message back
+// together:
+//
+//	marker (1) | message id (8) | index (2) | count (2) | payload
+//
+// Messages that fit in a single datagram are sent as they are, which keeps
+// small RPCs readable on the wire. An encoded RPC never starts with the
+// marker byte.
+const (
+	fragmentMarker     byte = 0xFE
+	fragmentHeaderSize      = 1 + 8 + 2 + 2
+	fragmentSize            = 1200  // Payload bytes carried by each fragment
+	maxDatagramSize         = 65535 // Largest datagram UDP can deliver
+	reassemblyTimeout       = 5 * time.Second
+)
+
+var ErrMessageTooLarge = errors.New("message exceeds the maximum message size")
+
+// maxMessageSize bounds a reassembled message. A stored value can grow up to
+// six times when it is escaped into JSON, and the envelope needs some room.
+func maxMessageSize(maxValueSize int) int {
+	return 6*maxValueSize + 16*1024
+}
+
+// fragment splits data into datagrams of at most fragmentSize payload bytes
+func fragment(data []byte, limit int) ([][]byte, error) {
+	if len(data) > limit {
+		return nil, ErrMessageTooLarge
+	}
+	if len(data) <= fragmentSize {
+		return [][]byte{data}, nil
+	}
+
+	count := (len(data) + fragmentSize - 1) / fragmentSize
+	if count > 0xFFFF {
+		return nil, ErrMessageTooLarge
+	}
+	messageID := rand.Uint64()
+
+	datagrams := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * fragmentSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := data[i*fragmentSize : end]
+
+		datagram := make([]byte, fragmentHeaderSize+len(chunk))
+		datagram[0] = fragmentMarker
+		binary.BigEndian.PutUint64(datagram[1:9], messageID)
+		binary.BigEndian.PutUint16(datagram[9:11], uint16(i))
+		binary.BigEndian.PutUint16(datagram[11:13], uint16(count))
+		copy(datagram[fragmentHeaderSize:], chunk)
+
+		datagrams = append(datagrams, datagram)
+	}
+	return datagrams, nil
+}
+
+// writeMessage sends data to address, fragmenting it when needed
+func writeMessage(transport Transport, address string, data []byte, limit int) error {
+	datagrams, err := fragment(data, limit)
+	if err != nil {
+		return err
+	}
+
+	for _, datagram := range datagrams {
+		if err := transport.Send(address, datagram); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type partialMessage struct {
+	fragments [][]byte
+	received  int
+	size      int
+	source    string // Source IP, which the number of partial messages is limited for
+	started   time.Time
+}
+
+// A source may have this many messages waiting for fragments at once
+const maxPartialPerSource = 4
+
+var errTooManyPartial = errors.New("too many incomplete messages from source")
+
+// reassembler collects fragments until every part of a message has arrived.
+// Messages that are not completed within reassemblyTimeout are discarded by
+// expireLoop.
+type reassembler struct {
+	mu        sync.Mutex
+	partial   map[string]*partialMessage
+	perSource map[string]int
+}
+
+func newReassembler() *reassembler {
+	return &reassembler{
+		partial:   make(map[string]*partialMessage),
+		perSource: make(map[string]int),
+	}
+}
+
+// add takes a received datagram and returns the complete message once all
+// of its fragments are in. Unfragmented datagrams are returned directly.
+func (r *reassembler) add(source string, datagram []byte, limit int) ([]byte, bool, error) {
+	if len(datagram) == 0 || datagram[0] != fragmentMarker {
+		return datagram, true, nil
+	}
+	if len(datagram) < fragmentHeaderSize {
+		return nil, false, errors.New("fragment header is truncated")
+	}
+
+	messageID := binary.BigEndian.Uint64(datagram[1:9])
+	index := int(binary.BigEndian.Uint16(datagram[9:11]))
+	count := int(binary.BigEndian.Uint16(datagram[11:13]))
+	payload := datagram[fragmentHeaderSize:]
+	if index >= count {
+		return nil, false, errors.New("fragment index is out of range")
+	}
+	if count*fragmentSize > limit+fragmentSize || len(payload) > fragmentSize {
+		return nil, false, ErrMessageTooLarge
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := fmt.Sprintf("%s/%d", source, messageID)
+	message, found := r.partial[key]
+	if !found {
+		ip := sourceIP(source)
+		if r.perSource[ip] >= maxPartialPerSource {
+			return nil, false, errTooManyPartial
+		}
+		message = &partialMessage{
+			fragments: make([][]byte, count),
+			source:    ip,
+			started:   time.Now(),
+		}
+		r.partial[key] = message
+		r.perSource[ip]++
+	}
+	if len(message.fragments) != count {
+		r.remove(key, message)
+		return nil, false, errors.New("fragment count changed within message")
+	}
+	if message.fragments[index] != nil {
+		return nil, false, nil // Duplicate fragment
+	}
+
+	// The read buffer is reused, so keep a copy of the payload
+	message.fragments[index] = append([]byte(nil), payload...)
+	message.received++
+	message.size += len(payload)
+	if message.size > limit {
+		r.remove(key, message)
+		return nil, false, ErrMessageTooLarge
+	}
+	if message.received < count {
+		return nil, false, nil
+	}
+
+	r.remove(key, message)
+	data := make([]byte, 0, message.size)
+	for _, part := range message.fragments {
+		data = append(data, part...)
+	}
+	return data, true, nil
+}
+
+// remove forgets a partial message. The caller holds mu.
+func (r *reassembler) remove(key string, message *partialMessage) {
+	delete(r.partial, key)
+	r.perSource[message.source]--
+	if r.perSource[message.source] <= 0 {
+		delete(r.perSource, message.source)
+	}
+}
+
+// expire drops messages that have been waiting for fragments too long
+func (r *reassembler) expire() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key, message := range r.partial {
+		if time.Since(message.started) > reassemblyTimeout {
+			r.remove(key, message)
+		}
+	}
+}
+
+// expireLoop expires incomplete messages until ctx is done. Checking twice
+// per timeout keeps none of them much longer than reassemblyTimeout.
+func (r *reassembler) expireLoop(ctx context.Context) {
+	ticker := time.NewTicker(reassemblyTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.expire()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFragmentAndReassemble(t *testing.T) {
+	data := bytes.Repeat([]byte("kademlia"), 1000) // 8000 bytes
+	limit := maxMessageSize(DefaultMaxValueSize)
+
+	datagrams, err := fragment(data, limit)
+	assert.NoError(t, err)
+	assert.Len(t, datagrams, 7)
+
+	// Deliver the fragments out of order, with one duplicate
+	r := newReassembler()
+	order := []int{3, 0, 6, 1, 1, 5, 2}
+	for _, i := range order {
+		_, complete, err := r.add("127.0.0.1:1000", datagrams[i], limit)
+		assert.NoError(t, err)
+		assert.False(t, complete)
+	}
+
+	message, complete, err := r.add("127.0.0.1:1000", datagrams[4], limit)
+	assert.NoError(t, err)
+	assert.True(t, complete)
+	assert.Equal(t, data, message)
+	assert.Empty(t, r.partial)
+}
+
+func TestFragmentSmallMessage(t *testing.T) {
+	data := []byte(`{"Type":"PingRequest"}`)
+
+	// Messages that fit in one datagram are not framed
+	datagrams, err := fragment(data, 1024)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{data}, datagrams)
+
+	message, complete, err := newReassembler().add("127.0.0.1:1000", data, 1024)
+	assert.NoError(t, err)
+	assert.True(t, complete)
+	assert.Equal(t, data, message)
+}
+
+func TestFragmentTooLarge(t *testing.T) {
+	data := make([]byte, 10*fragmentSize)
+
+	_, err := fragment(data, 5*fragmentSize)
+	assert.ErrorIs(t, err, ErrMessageTooLarge)
+
+	// The receiver also refuses messages announcing too many fragments
+	datagrams, _ := fragment(data, len(data))
+	_, _, err = newReassembler().add("127.0.0.1:1000", datagrams[0], 5*fragmentSize)
+	assert.ErrorIs(t, err, ErrMessageTooLarge)
+}
+
+func TestFragmentOversizedPayload(t *testing.T) {
+	limit := 5 * fragmentSize
+	datagrams, _ := fragment(make([]byte, 2*fragmentSize), limit)
+
+	// A fragment may not carry more than fragmentSize bytes
+	oversized := append(append([]byte(nil), datagrams[0]...), make([]byte, 1)...)
+	_, _, err := newReassembler().add("127.0.0.1:1000", oversized, limit)
+	assert.ErrorIs(t, err, ErrMessageTooLarge)
+
+	// The size is checked as the fragments come in, and a message that grows
+	// too large is given up right away
+	r := newReassembler()
+	_, _, err = r.add("127.0.0.1:1000", datagrams[0], 2*fragmentSize-1)
+	assert.NoError(t, err)
+	_, _, err = r.add("127.0.0.1:1000", datagrams[1], 2*fragmentSize-1)
+	assert.ErrorIs(t, err, ErrMessageTooLarge)
+	assert.Empty(t, r.partial)
+	assert.Empty(t, r.perSource)
+}
+
+func TestFragmentPartialMessagesPerSource(t *testing.T) {
+	limit := 5 * fragmentSize
+	r := newReassembler()
+
+	// The first fragment of a new message every time
+	first := func() []byte {
+		datagrams, _ := fragment(make([]byte, 2*fragmentSize), limit)
+		return datagrams[0]
+	}
+
+	// Other ports of the same IP count as the same source
+	for i := 0; i < maxPartialPerSource; i++ {
+		_, _, err := r.add(fmt.Sprintf("127.0.0.1:%d", 1000+i), first(), limit)
+		assert.NoError(t, err)
+	}
+	_, _, err := r.add("127.0.0.1:2000", first(), limit)
+	assert.ErrorIs(t, err, errTooManyPartial)
+
+	// Other sources are not affected
+	_, _, err = r.add("127.0.0.2:1000", first(), limit)
+	assert.NoError(t, err)
+
+	// Expired messages make room again
+	for _, message := range r.partial {
+		message.started = time.Now().Add(-2 * reassemblyTimeout)
+	}
+	r.expire()
+	assert.Empty(t, r.partial)
+	assert.Empty(t, r.perSource)
+	_, _, err = r.add("127.0.0.1:2000", first(), limit)
+	assert.NoError(t, err)
+}
+
+func TestStoreLargeData(t *testing.T) {
+	switchboard := NewSwitchboard()
+	bootstrapNode := startMemoryNode(t, switchboard, "10.14.1.1:1337")
+	secondNode := startMemoryNode(t, switchboard, "10.14.1.2:1337")
+
+	_ = secondNode.JoinNetwork(context.Background(), &bootstrapNode.Self)
+
+	// Much larger than a single datagram
+	dataToStore := bytes.Repeat([]byte("Lagrar stora saker "), 500)
+	hash, err := secondNode.Store(context.Background(), dataToStore)
+	assert.NoError(t, err)
+
+	// The bootstrap node received the whole value
+	storedData, found := bootstrapNode.getDataFromStore(hash)
+	assert.True(t, found)
+	assert.Equal(t, dataToStore, storedData)
+
+	_, retrievedData, _ := bootstrapNode.Lookup(context.Background(), hash)
+	assert.Equal(t, dataToStore, retrievedData)
+
+	// Values above the configured maximum are rejected with a clear error
+	_, err = secondNode.Store(context.Background(), make([]byte, DefaultMaxValueSize+1))
+	assert.ErrorIs(t, err, ErrValueTooLarge)
+}
@@ -0,0 +1,147 @@
+package internal
+
+import "time"
+
+// Weights of a new round-trip sample in the smoothed RTT and its variation,
+// as in TCP (RFC 6298)
+const (
+	rttGain    = 8
+	rttVarGain = 4
+)
+
+// Bounds of the timeout computed from a contact's round-trip time, unless a
+// RetryPolicy sets its own minimum. A floor well above LAN round-trip times
+// keeps a short stall of a healthy peer, such as a garbage collection or a
+// full worker queue, from costing it its place in the routing table. Above
+// the maximum a contact is as good as gone.
+const (
+	defaultMinTimeout = 200 * time.Millisecond
+	maxTimeout        = 10 * time.Second
+)
+
+// ContactHealth is what the routing table has learned about how a contact
+// answers us
+type ContactHealth struct {
+	LastSeen time.Time     // Last time the contact was heard from
+	RTT      time.Duration // Smoothed round-trip time, zero until measured
+	RTTVar   time.Duration // Smoothed variation of the round-trip time
+	Failures int           // Requests in a row the contact left unanswered
+}
+
+// Timeout returns how long to wait for the contact to answer: its smoothed
+// round-trip time plus four times the variation, like the retransmission
+// timeout of TCP, but no less than the policy's MinTimeout. Contacts without
+// a measured round-trip time get the policy's Timeout.
+func (health ContactHealth) Timeout(policy RetryPolicy) time.Duration {
+	if health.RTT == 0 {
+		return policy.Timeout
+	}
+
+	minTimeout := policy.MinTimeout
+	if minTimeout <= 0 {
+		minTimeout = defaultMinTimeout
+	}
+
+	timeout := health.RTT + 4*health.RTTVar
+	if timeout < minTimeout {
+		return minTimeout
+	}
+	if timeout > maxTimeout {
+		return maxTimeout
+	}
+	return timeout
+}
+
+// healthOf returns the health of a contact in the bucket, or nil for
+// contacts that are not. Contacts in the replacement cache have none yet.
+func (bucket *bucket) healthOf(id *KademliaID) *ContactHealth {
+	if !bucket.Contains(id) {
+		return nil
+	}
+	health, found := bucket.health[*id]
+	if !found {
+		health = &ContactHealth{}
+		bucket.health[*id] = health
+	}
+	return health
+}
+
+// seen records that the contact was heard from
+func (bucket *bucket) seen(id *KademliaID) {
+	if health := bucket.healthOf(id); health != nil {
+		health.LastSeen = time.Now()
+	}
+}
+
+// Health returns what is known about the contact with the ID, and false if
+// it is not in the RoutingTable
+func (routingTable *RoutingTable) Health(id *KademliaID) (ContactHealth, bool) {
+	if id == nil {
+		return ContactHealth{}, false
+	}
+
+	bucketIndex := routingTable.getBucketIndex(id)
+	routingTable.mu.Lock()
+	defer routingTable.mu.Unlock()
+
+	health := routingTable.buckets[bucketIndex].healthOf(id)
+	if health == nil {
+		return ContactHealth{}, false
+	}
+	return *health, true
+}
+
+// recordResponse notes that the contact answered a request, rtt after it was
+// sent. A zero rtt only marks the contact as seen, for responses that can not
+// be matched to one attempt.
+func (routingTable *RoutingTable) recordResponse(id *KademliaID, rtt time.Duration) {
+	if id == nil {
+		return
+	}
+
+	bucketIndex := routingTable.getBucketIndex(id)
+	routingTable.mu.Lock()
+	defer routingTable.mu.Unlock()
+
+	health := routingTable.buckets[bucketIndex].healthOf(id)
+	if health == nil {
+		return
+	}
+	health.LastSeen = time.Now()
+	health.Failures = 0
+	if rtt <= 0 {
+		return
+	}
+	if health.RTT == 0 {
+		health.RTT = rtt
+		health.RTTVar = rtt / 2
+		return
+	}
+
+	deviation := rtt - health.RTT
+	if deviation < 0 {
+		deviation = -deviation
+	}
+	health.RTTVar += (deviation - health.RTTVar) / rttVarGain
+	health.RTT += (rtt - health.RTT) / rttGain
+}
+
+// recordFailure counts a request the contact left unanswered and returns how
+// many it has missed in a row. Contacts outside the RoutingTable are not
+// counted.
+func (routingTable *RoutingTable) recordFailure(id *KademliaID) int {
+	if id == nil {
+		return 0
+	}
+
+	bucketIndex := routingTable.getBucketIndex(id)
+	routingTable.mu.Lock()
+	defer routingTable.mu.Unlock()
+
+	health := routingTable.buckets[bucketIndex].healthOf(id)
+	if health == nil {
+		return 0
+	}
+	health.Failures++
+	return health.Failures
+}
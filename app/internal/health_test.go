@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContactHealth(t *testing.T) {
+	rt := NewRoutingTable(NewContact(NewRandomKademliaID(), "localhost:8000"))
+	contact := NewContact(NewRandomKademliaID(), "localhost:8001")
+
+	// Contacts outside the routing table have no health and are not counted
+	_, found := rt.Health(contact.ID)
+	assert.False(t, found)
+	assert.Equal(t, 0, rt.recordFailure(contact.ID))
+	assert.Equal(t, 0, rt.recordFailure(nil))
+
+	before := time.Now()
+	rt.AddContact(contact)
+	health, found := rt.Health(contact.ID)
+	assert.True(t, found)
+	assert.False(t, health.LastSeen.Before(before))
+	assert.Zero(t, health.RTT)
+
+	// The first sample is taken as it is, later ones are smoothed
+	rt.recordResponse(contact.ID, 80*time.Millisecond)
+	rt.recordResponse(contact.ID, 160*time.Millisecond)
+	health, _ = rt.Health(contact.ID)
+	assert.Equal(t, 90*time.Millisecond, health.RTT)
+	assert.Equal(t, 50*time.Millisecond, health.RTTVar)
+
+	// Failures count up until the contact answers again
+	assert.Equal(t, 1, rt.recordFailure(contact.ID))
+	assert.Equal(t, 2, rt.recordFailure(contact.ID))
+	rt.recordResponse(contact.ID, 0)
+	health, _ = rt.Health(contact.ID)
+	assert.Equal(t, 0, health.Failures)
+	assert.Equal(t, 90*time.Millisecond, health.RTT, "Responses without a sample keep the RTT")
+
+	// A contact that comes back starts over
+	assert.Equal(t, 1, rt.recordFailure(contact.ID))
+	rt.RemoveContact(contact)
+	rt.AddContact(contact)
+	health, _ = rt.Health(contact.ID)
+	assert.Equal(t, 0, health.Failures)
+	assert.Zero(t, health.RTT)
+}
+
+func TestHealthTimeout(t *testing.T) {
+	policy := RetryPolicy{Timeout: 500 * time.Millisecond}
+
+	// Contacts that were never measured get the policy's timeout
+	assert.Equal(t, policy.Timeout, ContactHealth{}.Timeout(policy))
+
+	health := ContactHealth{RTT: 100 * time.Millisecond, RTTVar: 50 * time.Millisecond}
+	assert.Equal(t, 300*time.Millisecond, health.Timeout(policy))
+
+	// The timeout stays within its bounds however fast or slow the contact is
+	health = ContactHealth{RTT: time.Millisecond}
+	assert.Equal(t, defaultMinTimeout, health.Timeout(policy))
+	health = ContactHealth{RTT: 8 * time.Second, RTTVar: time.Second}
+	assert.Equal(t, maxTimeout, health.Timeout(policy))
+
+	// The policy can move the lower bound
+	health = ContactHealth{RTT: time.Millisecond, RTTVar: time.Millisecond}
+	policy.MinTimeout = 2 * time.Millisecond
+	assert.Equal(t, 5*time.Millisecond, health.Timeout(policy))
+	policy.MinTimeout = time.Second
+	assert.Equal(t, time.Second, health.Timeout(policy))
+}
+
+func TestExchangeMeasuresRTT(t *testing.T) {
+	switchboard := NewSwitchboard()
+	node := startMemoryNode(t, switchboard, "10.13.0.1:1337")
+	peer := startMemoryNode(t, switchboard, "10.13.0.2:1337")
+
+	network := &Network{Node: node}
+	_, err := network.SendPingMessage(&peer.Self)
+	assert.NoError(t, err)
+
+	health, found := node.Routes.Health(peer.Self.ID)
+	assert.True(t, found, "The peer should be added when it answers")
+	assert.Positive(t, health.RTT)
+	assert.Equal(t, 0, health.Failures)
+	assert.WithinDuration(t, time.Now(), health.LastSeen, time.Second)
+
+	// The peer heard from us as well
+	_, found = peer.Routes.Health(node.Self.ID)
+	assert.True(t, found)
+}
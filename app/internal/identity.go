@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Name of the file in the data directory holding the node's private key
+const identityFile = "identity.pem"
+
+// Identity is the keypair a node is known by. The node ID is derived from the
+// public key, so it does not change when the node gets a new address and
+// nobody can choose the ID they end up with.
+type Identity struct {
+	PublicKey  ed25519.PublicKey
+	PrivateKey ed25519.PrivateKey
+	Nonce      *KademliaID // Solution of the dynamic crypto puzzle, if any
+}
+
+// Header of the identity file holding the dynamic puzzle solution
+const nonceHeader = "Puzzle-Nonce"
+
+// GenerateIdentity creates a new random identity that solves the crypto
+// puzzles of the given difficulty
+func GenerateIdentity(difficulty PuzzleDifficulty) (*Identity, error) {
+	for {
+		publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("generating identity: %w", err)
+		}
+
+		identity := &Identity{PublicKey: publicKey, PrivateKey: privateKey}
+		if difficulty.checkStatic(identity.ID()) != nil {
+			continue
+		}
+		return identity, identity.solve(difficulty)
+	}
+}
+
+// LoadIdentity reads the identity kept in dataDir. The first time a node
+// starts there is none, so a new one is generated and saved for the next
+// start. When the dynamic puzzle has become harder a new solution is found
+// and saved, but an ID failing the static puzzle can only be replaced by
+// deleting the identity file.
+func LoadIdentity(dataDir string, difficulty PuzzleDifficulty) (*Identity, error) {
+	path := filepath.Join(dataDir, identityFile)
+
+	encoded, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		identity, err := GenerateIdentity(difficulty)
+		if err != nil {
+			return nil, err
+		}
+		return identity, identity.save(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading identity: %w", err)
+	}
+
+	block, _ := pem.Decode(encoded)
+	if block == nil {
+		return nil, fmt.Errorf("reading identity: %s is not a PEM file", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("reading identity: %w", err)
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("reading identity: %s does not hold an ed25519 key", path)
+	}
+
+	identity := &Identity{
+		PublicKey:  privateKey.Public().(ed25519.PublicKey),
+		PrivateKey: privateKey,
+	}
+	if nonce, found := block.Headers[nonceHeader]; found {
+		decoded, err := hex.DecodeString(nonce)
+		if err != nil || len(decoded) != IDLength {
+			return nil, fmt.Errorf("reading identity: bad %s header in %s", nonceHeader, path)
+		}
+		identity.Nonce = &KademliaID{}
+		copy(identity.Nonce[:], decoded)
+	}
+
+	if err := difficulty.checkStatic(identity.ID()); err != nil {
+		return nil, fmt.Errorf("identity in %s: %w", path, err)
+	}
+	if difficulty.check(identity.ID(), identity.Nonce) != nil {
+		if err := identity.solve(difficulty); err != nil {
+			return nil, err
+		}
+		return identity, identity.save(path)
+	}
+	return identity, nil
+}
+
+// solve finds the solution to the dynamic puzzle of the identity
+func (identity *Identity) solve(difficulty PuzzleDifficulty) error {
+	if difficulty.Dynamic == 0 {
+		return nil
+	}
+
+	nonce, err := solveDynamic(identity.ID(), difficulty.Dynamic)
+	if err != nil {
+		return err
+	}
+	identity.Nonce = nonce
+	return nil
+}
+
+// save writes the private key to path, readable by the owner only
+func (identity *Identity) save(path string) error {
+	der, err := x509.MarshalPKCS8PrivateKey(identity.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("saving identity: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("saving identity: %w", err)
+	}
+	block := &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	if identity.Nonce != nil {
+		block.Headers = map[string]string{nonceHeader: hex.EncodeToString(identity.Nonce[:])}
+	}
+	encoded := pem.EncodeToMemory(block)
+	if err := os.WriteFile(path, encoded, 0600); err != nil {
+		return fmt.Errorf("saving identity: %w", err)
+	}
+	return nil
+}
+
+// ID returns the node ID belonging to the identity
+func (identity *Identity) ID() *KademliaID {
+	return idForKey(identity.PublicKey)
+}
+
+// idForKey derives a node ID from a public key, it is the SHA-1 hash of the key
+func idForKey(publicKey ed25519.PublicKey) *KademliaID {
+	id := KademliaID(sha1.Sum(publicKey))
+	return &id
+}
+
+// mustRandom panics on an error from crypto/rand. It only happens when the
+// system has no source of randomness left, and without one no key, ID or
+// token a node makes can be trusted.
+func mustRandom(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,40 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadIdentity(t *testing.T) {
+	dataDir := filepath.Join(t.TempDir(), "node")
+
+	// The first start generates the identity and saves it
+	identity, err := LoadIdentity(dataDir, PuzzleDifficulty{})
+	assert.NoError(t, err)
+	info, err := os.Stat(filepath.Join(dataDir, identityFile))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// Later starts get the same identity and thereby the same ID
+	reloaded, err := LoadIdentity(dataDir, PuzzleDifficulty{})
+	assert.NoError(t, err)
+	assert.Equal(t, identity.PrivateKey, reloaded.PrivateKey)
+	assert.Equal(t, identity.ID(), reloaded.ID())
+
+	// Other data directories get identities of their own
+	other, err := LoadIdentity(t.TempDir(), PuzzleDifficulty{})
+	assert.NoError(t, err)
+	assert.NotEqual(t, identity.ID(), other.ID())
+}
+
+func TestLoadBrokenIdentity(t *testing.T) {
+	dataDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dataDir, identityFile), []byte("not a key"), 0600))
+
+	// A broken file is reported rather than silently replaced by a new ID
+	_, err := LoadIdentity(dataDir, PuzzleDifficulty{})
+	assert.Error(t, err)
+}
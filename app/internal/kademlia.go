@@ -1,6 +1,8 @@
 package internal
 
 import (
+	"context"
+	"errors"
 	"log"
 	"sync"
 	"time"
@@ -10,19 +12,59 @@ import (
 
 type Kademlia struct {
 	Self      Contact // NOTE: This might not be necessary since the routing table comes with "me"
+	Identity  *Identity
 	Routes    *RoutingTable
+	pending   *pendingContacts // contacts from responses waiting to answer a ping
+	evictions *pendingContacts // least recently seen contacts of full buckets
 	Datastore *Datastore
-	mu        sync.Mutex
+	endpoint  *endpoint         // socket shared by Listen and all outgoing RPCs
+	peers     *peerCapabilities // what the peers we heard from support
+	retry     *retrySettings    // RPC retry policies and the failures that evict a contact
+	puzzle    *puzzleSettings
+	sessions  *sessionSettings // key exchange key and sessions for encrypted RPCs
+	swarm     *swarmSettings   // pre-shared key of a private network
+	workers   *workerSettings
+	limiter   *rateLimiter // limits and bans on incoming requests
+	replays   *replayWindow
+	tokens    *storeTokens // tokens handed out to and received for STORE
+	refresh   *refreshSettings
+	life      *lifecycle // background tasks stopped by Close
+	started   time.Time
 }
 
 // A system-wide concurrency parameter, such as 3.
 const alpha int = 3
 
-func NewKademliaNode(address string) (node Kademlia) {
-	id := NewKademliaID(utils.Hash(address))
-	node.Self = NewContact(id, address) // and store to contact object
+// NewKademliaNode creates a node with a new random identity, which is lost
+// when the process exits. Use NewKademliaNodeWithIdentity to keep the same ID
+// across restarts.
+func NewKademliaNode(address string) Kademlia {
+	identity, err := GenerateIdentity(PuzzleDifficulty{})
+	mustRandom(err)
+	return NewKademliaNodeWithIdentity(address, identity)
+}
+
+// NewKademliaNodeWithIdentity creates a node whose ID is derived from identity
+func NewKademliaNodeWithIdentity(address string, identity *Identity) (node Kademlia) {
+	node.Identity = identity
+	node.Self = NewContact(identity.ID(), address) // and store to contact object
 	node.Routes = NewRoutingTable(node.Self)
+	node.pending = newPendingContacts()
+	node.evictions = newPendingContacts()
 	node.Datastore = NewDataStore()
+	node.endpoint = newEndpoint()
+	node.peers = newPeerCapabilities()
+	node.retry = newRetrySettings()
+	node.puzzle = &puzzleSettings{}
+	node.sessions = newSessionSettings()
+	node.swarm = &swarmSettings{}
+	node.workers = newWorkerSettings()
+	node.limiter = newRateLimiter()
+	node.replays = newReplayWindow()
+	node.tokens = newStoreTokens()
+	node.refresh = newRefreshSettings()
+	node.life = newLifecycle()
+	node.started = time.Now()
 
 	return
 }
@@ -31,27 +73,34 @@ func NewKademliaNode(address string) (node Kademlia) {
 // the appropriate k-bucket. u then performs a node lookup for its own node ID. Finally, u refreshes all k-
 // buckets further away than its closest neighbor. During the refreshes, u both populates its own k-buckets
 // and inserts itself into other nodes’ k-buckets as necessary
-func (u *Kademlia) JoinNetwork(w *Contact) []Contact {
+func (u *Kademlia) JoinNetwork(ctx context.Context, w *Contact) []Contact {
 	// Add the bootstrap do the routing table
 	u.Routes.AddContact(*w)
 	// Perform a lookup on ourself
-	u.mu.Lock()
-	contacts, _, _ := u.Lookup(u.Self.ID)
-	u.mu.Unlock()
+	contacts, _, _ := u.Lookup(ctx, u.Self.ID)
+
+	// Refresh the buckets further away than our closest neighbour, which
+	// the lookup for our own ID did not go through
+	if buckets := u.Routes.IdleBuckets(0); len(buckets) > 0 && u.refresh.refreshes() {
+		u.refreshBuckets(ctx, buckets[:len(buckets)-1])
+	}
 
 	return contacts
 }
 
-func (kademlia *Kademlia) Lookup(targetOrHash interface{}) ([]Contact, []byte, Contact) {
+// Lookup finds the closest contacts to a *KademliaID or the data stored
+// under a hash. When ctx is done or the node is closed the lookup stops and
+// returns what it has found so far.
+func (kademlia *Kademlia) Lookup(ctx context.Context, targetOrHash interface{}) ([]Contact, []byte, Contact) {
 	switch t := targetOrHash.(type) {
 	case *KademliaID:
 		// Handle contact lookup
-		contacts := kademlia.LookupContact(t)
+		contacts := kademlia.LookupContact(ctx, t)
 		return contacts, nil, Contact{}
 
 	case string:
 		// Handle data lookup
-		data, con := kademlia.LookupData(t)
+		data, con, _ := kademlia.LookupData(ctx, t)
 		return nil, data, con
 
 	default:
@@ -60,7 +109,12 @@ func (kademlia *Kademlia) Lookup(targetOrHash interface{}) ([]Contact, []byte, C
 }
 
 // LookupContact "...to locate the k closest nodes to some given node ID"
-func (kademlia *Kademlia) LookupContact(target *KademliaID) (k_nodes []Contact) {
+func (kademlia *Kademlia) LookupContact(ctx context.Context, target *KademliaID) (k_nodes []Contact) {
+	ctx, cancel := kademlia.withNode(ctx)
+	defer cancel()
+
+	kademlia.Routes.Touch(target)
+
 	network := &Network{}
 	network.Node = kademlia
 	ch := make(chan []Contact)
@@ -72,14 +126,14 @@ func (kademlia *Kademlia) LookupContact(target *KademliaID) (k_nodes []Contact)
 	// The contact closest to the target key, closestNode, is noted.
 	if shortlist.Len() < alpha {
 		// If shortlist length is less than alpha, perform the lookup for the first node.
-		go PerformLookup(*target, shortlist.Nodes[0].Node, *network, ch, conCh)
+		go PerformLookup(ctx, *target, shortlist.Nodes[0].Node, *network, ch, conCh)
 	} else {
 		//"The node then sends parallel, asynchronous FIND_* RPCs to the alpha contacts in the shortlist."
 		for i := 0; i < alpha; i++ {
-			go PerformLookup(*target, shortlist.Nodes[i].Node, *network, ch, conCh)
+			go PerformLookup(ctx, *target, shortlist.Nodes[i].Node, *network, ch, conCh)
 		}
 	}
-	shortlist.updateShortList(*target, ch, conCh, *network)
+	shortlist.updateShortList(ctx, *target, ch, conCh, *network)
 
 	// creating the result list
 	for _, insItem := range shortlist.Nodes {
@@ -89,66 +143,146 @@ func (kademlia *Kademlia) LookupContact(target *KademliaID) (k_nodes []Contact)
 	return
 }
 
-// Given a hash from data, finds the closest node where the data is to be stored
-func (kademlia *Kademlia) LookupData(hash string) ([]byte, Contact) {
+// Given a hash from data, finds the closest node where the data is to be stored.
+// When the data is not found and no node answered at all, the errors of the
+// requests are returned joined together. A lookup cut short by ctx returns
+// its error, one cut short by Close ErrNodeClosed.
+func (kademlia *Kademlia) LookupData(ctx context.Context, hash string) ([]byte, Contact, error) {
+	requestCtx := ctx
+	ctx, cancel := kademlia.withNode(ctx)
+	defer cancel()
+
 	net := &Network{}
 	net.Node = kademlia
 
 	hashID := NewKademliaID(hash) // create kademlia ID from the hashed data
+	kademlia.Routes.Touch(hashID)
 	shortlist := kademlia.NewShortList(hashID)
 
 	ch := make(chan []Contact)          // channel -> returns contacts
 	targetData := make(chan []byte)     // channel -> when the data is found it is communicated through this channel
 	dataContactCh := make(chan Contact) // channel that only takes the contact that returned the data
+	errs := &lookupErrors{}             // why the requests that did not get an answer failed
 
 	if shortlist.Len() < alpha {
-		go PerformLookupData(hash, shortlist.Nodes[0].Node, *net, ch, targetData, dataContactCh)
+		go PerformLookupData(ctx, hash, shortlist.Nodes[0].Node, *net, ch, targetData, dataContactCh, errs)
 	} else {
 		// sending RPCs to the alpha nodes async
 		for i := 0; i < alpha; i++ {
-			go PerformLookupData(hash, shortlist.Nodes[i].Node, *net, ch, targetData, dataContactCh)
+			go PerformLookupData(ctx, hash, shortlist.Nodes[i].Node, *net, ch, targetData, dataContactCh, errs)
 		}
 	}
 
-	data, con := shortlist.updateLookupData(hash, ch, targetData, dataContactCh, *net)
+	data, con := shortlist.updateLookupData(ctx, hash, ch, targetData, dataContactCh, *net, errs)
+	if data != nil {
+		return data, con, nil
+	}
+	if ctx.Err() != nil {
+		if err := requestCtx.Err(); err != nil {
+			return nil, Contact{}, err
+		}
+		return nil, Contact{}, ErrNodeClosed
+	}
+	return nil, Contact{}, errs.err()
+}
+
+// lookupErrors collects the errors of the requests of a lookup
+type lookupErrors struct {
+	mu       sync.Mutex
+	errs     []error
+	answered int
+}
 
-	// creating the resultdata, con :=shortlist.updateLook list
-	return data, con
+func (lookupErrs *lookupErrors) add(err error) {
+	lookupErrs.mu.Lock()
+	defer lookupErrs.mu.Unlock()
+
+	if err != nil {
+		lookupErrs.errs = append(lookupErrs.errs, err)
+	} else {
+		lookupErrs.answered++
+	}
 }
 
-func PerformLookup(targetID KademliaID, receiver Contact, net Network, ch chan []Contact, conCh chan Contact) {
+// err returns the errors joined together if not a single request was
+// answered. Otherwise the lookup reached the network and simply found
+// nothing.
+func (lookupErrs *lookupErrors) err() error {
+	lookupErrs.mu.Lock()
+	defer lookupErrs.mu.Unlock()
+
+	if lookupErrs.answered > 0 {
+		return nil
+	}
+	return errors.Join(lookupErrs.errs...)
+}
+
+// PerformLookup sends one FIND_NODE RPC and hands the result to the lookup,
+// unless the lookup has been given up by then
+func PerformLookup(ctx context.Context, targetID KademliaID, receiver Contact, net Network, ch chan []Contact, conCh chan Contact) {
 	resultingNodes, _ := net.SendFindContactMessage(&receiver, &targetID)
-	ch <- resultingNodes
-	conCh <- receiver
+	select {
+	case ch <- resultingNodes:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case conCh <- receiver:
+	case <-ctx.Done():
+	}
 }
 
 // runs SendFindDataMessage and loads response into two channels:
 // ch -> contacts close to the data hash
 // target -> the target data
-func PerformLookupData(hash string, receiver Contact, net Network, ch chan []Contact, target chan []byte, dataContactCh chan Contact) {
-	targetData, reslist, dataContact, _ := net.SendFindDataMessage(&receiver, hash)
-	ch <- reslist
-	target <- targetData
-	dataContactCh <- dataContact
+func PerformLookupData(ctx context.Context, hash string, receiver Contact, net Network, ch chan []Contact, target chan []byte, dataContactCh chan Contact, errs *lookupErrors) {
+	targetData, reslist, dataContact, err := net.SendFindDataMessage(&receiver, hash)
+	errs.add(err)
+	select {
+	case ch <- reslist:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case target <- targetData:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case dataContactCh <- dataContact:
+	case <-ctx.Done():
+	}
 }
 
-func (kademlia *Kademlia) Store(data []byte) (key string) {
+// Store saves the data locally and on the k closest nodes to its hash. Values
+// larger than the datastore's MaxValueSize are rejected with ErrValueTooLarge,
+// and if none of the closest nodes accepted the value their errors are
+// returned joined together. The value is refreshed in the background until it
+// is forgotten or the node is closed.
+func (kademlia *Kademlia) Store(ctx context.Context, data []byte) (key string, err error) {
+	if len(data) > kademlia.Datastore.MaxValueSize {
+		return "", ErrValueTooLarge
+	}
+
 	net := &Network{}
 	net.Node = kademlia
 	key = utils.Hash(string(data))
 
-	kademlia.mu.Lock()
 	kademlia.Datastore.putData(key, data)
 	hashID := NewKademliaID(key)
-	contactsToStore, _, _ := kademlia.Lookup(hashID)
-	kademlia.mu.Unlock()
+	contactsToStore, _, _ := kademlia.Lookup(ctx, hashID)
 
+	var storeErrs []error
 	for _, target := range contactsToStore {
 
-		net.SendStoreMessage(data, &target)
+		_, storeErr := net.SendStoreMessage(data, &target)
+		if storeErr != nil {
+			storeErrs = append(storeErrs, storeErr)
+		}
 
 		// U2.
-		go func(contact Contact, key string) {
+		contact := target
+		kademlia.life.spawn(func(ctx context.Context) {
 			refreshTicker := time.NewTicker(kademlia.Datastore.TTL / 2)
 			defer refreshTicker.Stop()
 
@@ -169,9 +303,16 @@ func (kademlia *Kademlia) Store(data []byte) (key string) {
 				case <-time.After(kademlia.Datastore.TTL):
 					log.Println("TTL elapsed. Exiting goroutine.")
 					return
+
+				case <-ctx.Done():
+					return
 				}
 			}
-		}(target, key)
+		})
+	}
+
+	if len(contactsToStore) > 0 && len(storeErrs) == len(contactsToStore) {
+		err = errors.Join(storeErrs...)
 	}
 
 	return
@@ -1,6 +1,9 @@
 package internal
 
 import (
+	"context"
+	"fmt"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -15,8 +18,10 @@ func TestNewKademliaNode(t *testing.T) {
 	assert.NotNil(t, node)
 	assert.NotNil(t, node2)
 
-	// Check if the Kademlia IDs are the same
-	assert.Equal(t, node.Self.ID, node2.Self.ID)
+	// The ID comes from the identity, not from the address
+	assert.NotEqual(t, node.Self.ID, node2.Self.ID)
+	moved := NewKademliaNodeWithIdentity("127.0.0.2:1337", node.Identity)
+	assert.Equal(t, node.Self.ID, moved.Self.ID)
 
 	// Add assertions to validate the node's properties
 	assert.NotNil(t, node)
@@ -38,14 +43,16 @@ func TestJoinNetworkAndLookup(t *testing.T) {
 	bootNetwork := &Network{}
 	bootNetwork.Node = &bootstrapNode
 
-	go bootNetwork.Listen("127.0.0.1", 1337)
+	go bootNetwork.Listen(context.Background(), "127.0.0.1", 1337)
 
 	joinNetwork := &Network{}
-	joinNetwork.Node = &bootstrapNode
+	joinNetwork.Node = &secondNode
+
+	// The second node sends its requests from its listening socket
+	go joinNetwork.Listen(context.Background(), "127.0.0.1", 1338)
 
 	// Perform the join operation and get the contacts
-	contacts := secondNode.JoinNetwork(&bootstrapNode.Self)
-	go joinNetwork.Listen("127.0.0.1", 1338)
+	contacts := secondNode.JoinNetwork(context.Background(), &bootstrapNode.Self)
 
 	// Assert that the contacts slice has a length greater than 0
 	assert.NotNil(t, contacts)
@@ -65,21 +72,24 @@ func TestStoreData(t *testing.T) {
 	bootNetwork := &Network{}
 	bootNetwork.Node = &bootstrapNode
 
-	go bootNetwork.Listen("127.0.0.1", 1120)
+	go bootNetwork.Listen(context.Background(), "127.0.0.1", 1120)
 
 	joinNetwork := &Network{}
-	joinNetwork.Node = &bootstrapNode
+	joinNetwork.Node = &secondNode
+
+	// The second node sends its requests from its listening socket
+	go joinNetwork.Listen(context.Background(), "127.0.0.1", 1121)
 
 	// Perform the join operation and get the contacts
-	_ = secondNode.JoinNetwork(&bootstrapNode.Self)
-	go joinNetwork.Listen("127.0.0.1", 1121)
+	_ = secondNode.JoinNetwork(context.Background(), &bootstrapNode.Self)
 
 	dataToStore := "Lagrar saker för testning"
-	hash := secondNode.Store([]byte(dataToStore))
+	hash, err := secondNode.Store(context.Background(), []byte(dataToStore))
+	assert.NoError(t, err)
 	assert.NotEmpty(t, hash)
 
 	// Simulate retrieving the stored data
-	_, retrievedData, _ := secondNode.Lookup(hash)
+	_, retrievedData, _ := secondNode.Lookup(context.Background(), hash)
 
 	// Assert that the retrieved data matches the stored data
 	assert.Equal(t, []byte(dataToStore), retrievedData)
@@ -94,10 +104,47 @@ func TestLookupWithInvalidInput(t *testing.T) {
 	invalidInput := 12345 // Replace with your desired invalid input
 
 	// Call the Lookup method with the invalid input
-	contacts, data, contact := kademliaNode.Lookup(invalidInput)
+	contacts, data, contact := kademliaNode.Lookup(context.Background(), invalidInput)
 
 	// Assert that the returned values are as expected for an invalid input
 	assert.Nil(t, contacts, "Contacts should be nil for invalid input")
 	assert.Nil(t, data, "Data should be nil for invalid input")
 	assert.Equal(t, Contact{}, contact, "Contact should be an empty Contact for invalid input")
 }
+
+func TestConcurrentStoreAndLookup(t *testing.T) {
+	switchboard := NewSwitchboard()
+	bootstrap := startMemoryNode(t, switchboard, "10.12.0.1:1337")
+	nodes := []*Kademlia{bootstrap}
+	for i := 2; i <= 8; i++ {
+		node := startMemoryNode(t, switchboard, fmt.Sprintf("10.12.0.%d:1337", i))
+		node.JoinNetwork(context.Background(), &bootstrap.Self)
+		nodes = append(nodes, node)
+	}
+
+	// Every node stores a value and looks up the one of its neighbour, all
+	// at the same time
+	var wg sync.WaitGroup
+	hashes := make([]string, len(nodes))
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node *Kademlia) {
+			defer wg.Done()
+			hash, err := node.Store(context.Background(), []byte(fmt.Sprintf("Lagrar saker %d", i)))
+			assert.NoError(t, err)
+			hashes[i] = hash
+		}(i, node)
+	}
+	wg.Wait()
+
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node *Kademlia) {
+			defer wg.Done()
+			next := (i + 1) % len(nodes)
+			_, data, _ := node.Lookup(context.Background(), hashes[next])
+			assert.Equal(t, []byte(fmt.Sprintf("Lagrar saker %d", next)), data)
+		}(i, node)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"context"
+	"sync"
+)
+
+// lifecycle tracks what a node runs in the background: Serve and the loops
+// refreshing stored values. Close cancels the context they watch and waits
+// until every one of them has returned.
+type lifecycle struct {
+	ctx    context.Context // Cancelled when the node is closed
+	cancel context.CancelFunc
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func newLifecycle() *lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &lifecycle{ctx: ctx, cancel: cancel}
+}
+
+// add registers a background task, it fails once the node is closed
+func (lc *lifecycle) add() bool {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if lc.closed {
+		return false
+	}
+	lc.wg.Add(1)
+	return true
+}
+
+func (lc *lifecycle) done() {
+	lc.wg.Done()
+}
+
+// spawn runs task on its own goroutine until it returns or the node is closed
+func (lc *lifecycle) spawn(task func(ctx context.Context)) bool {
+	if !lc.add() {
+		return false
+	}
+	go func() {
+		defer lc.done()
+		task(lc.ctx)
+	}()
+	return true
+}
+
+// Close stops the node: lookups in progress are abandoned, pending requests
+// return ErrNodeClosed, the refresh loops stop and Serve closes the socket.
+// Close returns once all of them are done; calling it again does nothing.
+func (kademlia *Kademlia) Close() error {
+	lc := kademlia.life
+	lc.mu.Lock()
+	lc.closed = true
+	lc.mu.Unlock()
+
+	lc.cancel()
+	lc.wg.Wait()
+	return nil
+}
+
+// withNode returns a context that is done when ctx is done or the node is
+// closed, whichever happens first
+func (kademlia *Kademlia) withNode(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(kademlia.life.ctx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
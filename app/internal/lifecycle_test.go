@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloseStopsNode(t *testing.T) {
+	switchboard := NewSwitchboard()
+	node := NewKademliaNode("10.1.0.1:1337")
+	network := &Network{Node: &node}
+	transport, err := switchboard.Listen(node.Self.Address)
+	assert.NoError(t, err)
+
+	served := make(chan error, 1)
+	go func() { served <- network.Serve(context.Background(), transport) }()
+
+	// Nobody answers, so the ping is still waiting when the node is closed
+	network.SetRetryPolicy("PingRequest", RetryPolicy{Timeout: time.Minute})
+	deadContact := NewContact(NewRandomKademliaID(), "10.1.0.2:1337")
+	pinged := make(chan error, 1)
+	go func() {
+		_, err := network.SendPingMessage(&deadContact)
+		pinged <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, node.Close())
+
+	assert.NoError(t, <-served)
+	assert.ErrorIs(t, <-pinged, ErrNodeClosed)
+
+	// The address was given back when the transport was closed
+	_, err = switchboard.Listen(node.Self.Address)
+	assert.NoError(t, err)
+
+	// A closed node can not be served again, and closing twice is fine
+	transport, _ = switchboard.Listen("10.1.0.3:1337")
+	assert.ErrorIs(t, network.Serve(context.Background(), transport), ErrNodeClosed)
+	assert.NoError(t, node.Close())
+}
+
+func TestServeStopsWithContext(t *testing.T) {
+	switchboard := NewSwitchboard()
+	node := NewKademliaNode("10.1.1.1:1337")
+	network := &Network{Node: &node}
+	transport, _ := switchboard.Listen(node.Self.Address)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- network.Serve(ctx, transport) }()
+
+	cancel()
+	select {
+	case err := <-served:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return after the context was cancelled")
+	}
+}
+
+func TestLookupStopsWithContext(t *testing.T) {
+	switchboard := NewSwitchboard()
+	node := startMemoryNode(t, switchboard, "10.1.2.1:1337")
+	(&Network{Node: node}).SetRetryPolicy("FindContactRequest", RetryPolicy{Timeout: time.Minute})
+
+	// The only contact never answers, the lookup gives up when ctx expires
+	node.Routes.AddContact(NewContact(NewRandomKademliaID(), "10.1.2.2:1337"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	node.LookupContact(ctx, NewRandomKademliaID())
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestCloseStopsRefreshLoops(t *testing.T) {
+	switchboard := NewSwitchboard()
+	bootstrap := startMemoryNode(t, switchboard, "10.1.3.1:1337")
+	node := startMemoryNode(t, switchboard, "10.1.3.2:1337")
+	node.JoinNetwork(context.Background(), &bootstrap.Self)
+
+	_, err := node.Store(context.Background(), []byte("Lagrar saker som ska uppdateras"))
+	assert.NoError(t, err)
+
+	// Close waits for the refresh loops, which would otherwise run for a TTL
+	closed := make(chan struct{})
+	go func() {
+		node.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close did not stop the refresh loops")
+	}
+}
@@ -1,11 +1,13 @@
 package internal
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net"
 	"strconv"
+	"time"
 
 	"github.com/arek-e/D7024E/app/utils"
 )
@@ -14,91 +16,311 @@ type Network struct {
 	Node *Kademlia
 }
 
-func (network *Network) Listen(ip string, port int) {
-	addr := utils.AddressToUDPAddr(ip + ":" + strconv.Itoa(port))
+// SetCodec selects the encoding used for the requests this node sends.
+// Incoming messages are accepted in every encoding.
+func (network *Network) SetCodec(codec Codec) {
+	network.Node.endpoint.mu.Lock()
+	defer network.Node.endpoint.mu.Unlock()
 
-	conn, err := net.ListenUDP("udp", &addr)
+	network.Node.endpoint.codec = codec
+}
+
+// Codec returns the encoding used for the requests this node sends
+func (network *Network) Codec() Codec {
+	network.Node.endpoint.mu.Lock()
+	defer network.Node.endpoint.mu.Unlock()
+
+	return network.Node.endpoint.codec
+}
+
+// Listen binds a UDP socket on ip:port and serves RPCs on it until ctx is
+// done or the node is closed
+func (network *Network) Listen(ctx context.Context, ip string, port int) error {
+	address := ip + ":" + strconv.Itoa(port)
+
+	transport, err := NewUDPTransport(address)
 	if err != nil {
-		log.Fatalf("Error listening on %s:%d: %v", addr.IP, addr.Port, err)
-		return
+		return fmt.Errorf("listening on %s: %w", address, err)
+	}
+
+	return network.Serve(ctx, transport)
+}
+
+// Serve handles incoming RPCs on the transport until ctx is done, the node
+// is closed or the transport is closed, and closes the transport when it
+// returns. The same transport is used for outgoing requests, so peers always
+// see our listening address as the source address.
+func (network *Network) Serve(ctx context.Context, transport Transport) error {
+	if !network.Node.life.add() {
+		transport.Close()
+		return ErrNodeClosed
+	}
+	defer network.Node.life.done()
+
+	ctx, cancel := network.Node.withNode(ctx)
+	defer cancel()
+
+	// Closing the transport is what gets the read loop out of Receive
+	stopClose := context.AfterFunc(ctx, func() { transport.Close() })
+	defer func() {
+		if stopClose() {
+			transport.Close()
+		}
+	}()
+
+	if err := network.Node.endpoint.bind(transport); err != nil {
+		return fmt.Errorf("binding %s: %w", transport.LocalAddr(), err)
 	}
-	defer conn.Close()
 
-	log.Printf("Listening on: %s:%d", addr.IP, addr.Port)
+	log.Printf("Listening on: %s", transport.LocalAddr())
+
+	buffer := make([]byte, maxDatagramSize)
+	limit := maxMessageSize(network.Node.Datastore.MaxValueSize)
 
-	buffer := make([]byte, 1024)
+	// Requests are answered by the worker pool, so a slow handler never
+	// keeps us from reading responses to our own requests
+	pool := network.startWorkers(transport, limit)
+	defer pool.stop()
 
+	// Contacts from responses are verified in the background, and so are
+	// the contacts that may have to make room for new ones
+	if network.Node.life.add() {
+		go func() {
+			defer network.Node.life.done()
+			network.verifyPending(ctx)
+		}()
+	}
+	if network.Node.life.add() {
+		go func() {
+			defer network.Node.life.done()
+			network.checkEvictions(ctx)
+		}()
+	}
+
+	// Messages whose fragments stopped arriving are thrown away
+	if network.Node.life.add() {
+		go func() {
+			defer network.Node.life.done()
+			network.Node.endpoint.reassembler.expireLoop(ctx)
+		}()
+	}
+
+	// Buckets nobody looked up in for a while are refreshed
+	if network.Node.life.add() {
+		go func() {
+			defer network.Node.life.done()
+			network.refreshLoop(ctx)
+		}()
+	}
+
+	limiter := network.Node.limiter
 	for {
-		n, remoteaddr, err := conn.ReadFromUDP(buffer)
+		n, remoteaddr, err := transport.Receive(buffer)
+		if err == ErrTransportClosed || ctx.Err() != nil {
+			return nil
+		}
 		if err != nil {
-			log.Printf("Error reading from UDP: %v", err)
+			log.Printf("Error reading from transport: %v", err)
 			continue
 		}
 
-		receivedData := buffer[0:n]
-		parsedRPCRequest, err := DeserializeRPC(receivedData)
+		ip := sourceIP(remoteaddr)
+		if limiter.banned(ip) {
+			continue
+		}
+
+		// Large messages arrive in fragments, wait until we have all of them
+		receivedData, complete, err := network.Node.endpoint.reassembler.add(remoteaddr, buffer[0:n], limit)
 		if err != nil {
-			log.Printf("Error parsing RPC: %v", err)
+			log.Printf("Error reassembling message from %v: %v", remoteaddr, err)
+			limiter.reject(ip)
+			continue
+		}
+		if !complete {
+			continue
+		}
+
+		// The limits apply before the message costs us anything more than
+		// reassembly: decoding, the MAC and above all the signature check
+		if !limiter.admit(ip) {
 			continue
 		}
 
-		network.Node.Routes.AddContact(parsedRPCRequest.Sender)
-		responseRPC, err := network.CreateResponseRPC(parsedRPCRequest)
+		// Answer in the encoding the request was sent in, so nodes that only
+		// understand JSON keep working during an upgrade
+		codec := codecFor(receivedData)
+		parsedRPC, err := codec.Decode(receivedData)
 		if err != nil {
-			log.Printf("Response error: %v", err)
+			log.Printf("Error parsing RPC: %v", err)
+			limiter.reject(ip)
+			continue
+		}
+
+		// Some requests, like stores, cost us more and have limits of their own
+		if !isResponse(parsedRPC) && !limiter.allowType(ip, parsedRPC.Type) {
+			continue
+		}
+
+		// Traffic from outside our private network is dropped without a
+		// word, it is not a misbehaving peer but a different deployment
+		if err := network.Node.swarm.check(parsedRPC); err != nil {
+			continue
+		}
+
+		// Nodes of another version may not sign their messages the way we
+		// check them. Their requests are told which version we speak instead
+		// of being dropped, which is no misbehaviour worth a ban. Of their
+		// responses only refusals are passed on, so the caller learns why
+		// its request failed rather than waiting for a timeout.
+		if !supportedVersion(parsedRPC) {
+			if !isResponse(parsedRPC) {
+				network.refuseVersion(transport, incomingRequest{rpc: parsedRPC, codec: codec, from: remoteaddr}, limit)
+			} else if isRefusal(parsedRPC) {
+				// The sender is not verified, so nothing is learned about it
+				parsedRPC.Sender = Contact{Address: remoteaddr}
+				network.Node.endpoint.deliver(parsedRPC)
+			}
+			continue
+		}
+
+		// Nothing in a message is trusted before its signature is checked,
+		// in particular not the sender that goes into the routing table
+		if err := verify(parsedRPC); err != nil {
+			log.Printf("Dropping %s from %v: %v", parsedRPC.Type, remoteaddr, err)
+			limiter.reject(ip)
+			continue
+		}
+		if err := network.PuzzleDifficulty().check(parsedRPC.Sender.ID, parsedRPC.PuzzleNonce); err != nil {
+			log.Printf("Dropping %s from %v: %v", parsedRPC.Type, remoteaddr, err)
+			limiter.reject(ip)
+			continue
+		}
+
+		// Only what a verified message advertises decides which features
+		// we use with its sender
+		network.Node.peers.record(remoteaddr, parsedRPC.Capabilities)
+
+		// The address a node claims is only what it believes it is reachable
+		// on. Answers go to where the message came from, so that is the
+		// address the contact is known by.
+		if parsedRPC.Sender.Address != remoteaddr {
+			log.Printf("%v claims to be at %v, using the source address", remoteaddr, parsedRPC.Sender.Address)
+			parsedRPC.Sender.Address = remoteaddr
+		}
+
+		// Responses to our own requests are handed to the waiting caller
+		if isResponse(parsedRPC) {
+			if !network.Node.endpoint.deliver(parsedRPC) {
+				log.Printf("Dropping unexpected %s from %v", parsedRPC.Type, remoteaddr)
+			}
 			continue
 		}
 
-		serializedRPC, err := SerializeRPC(responseRPC)
+		// A signed request can still be sent again by anyone who saw it
+		if err := network.Node.replays.check(parsedRPC); err != nil {
+			log.Printf("Dropping %s from %v: %v", parsedRPC.Type, remoteaddr, err)
+			limiter.reject(ip)
+			continue
+		}
+
+		pool.dispatch(incomingRequest{rpc: parsedRPC, codec: codec, from: remoteaddr})
+	}
+}
+
+// handleRequest answers one request, it runs on a worker of the pool
+func (network *Network) handleRequest(transport Transport, request incomingRequest, limit int) {
+	network.addContact(request.rpc.Sender)
+
+	// A failing handler still answers, so the caller does not mistake us
+	// for a dead node
+	opened, session, err := network.openRequest(request.rpc)
+	var responseRPC RPC
+	if err == nil {
+		responseRPC, err = network.CreateResponseRPC(opened)
+	}
+	if err != nil {
+		log.Printf("Response error: %v", err)
+		responseRPC, err = network.createErrorResponse(request.rpc, err)
+		if err != nil {
+			return
+		}
+	}
+
+	// Encrypted requests get encrypted answers. Refusals stay readable, they
+	// may be about the session itself and carry nothing worth hiding.
+	if session != nil && remoteError(responseRPC) == nil {
+		responseRPC, err = session.seal(responseRPC)
 		if err != nil {
 			log.Printf("Response error: %v", err)
-			continue
+			return
 		}
+	}
+
+	network.respond(transport, request, responseRPC, limit)
+}
 
-		sendResponse(conn, remoteaddr, serializedRPC)
+// refuseVersion answers a request of a protocol version we do not speak with
+// an UnsupportedResponse. Its sender is not verified and stays out of the
+// routing table.
+func (network *Network) refuseVersion(transport Transport, request incomingRequest, limit int) {
+	responseRPC, err := network.CreateResponseRPC(request.rpc)
+	if err != nil {
+		log.Printf("Response error: %v", err)
+		return
 	}
+	network.respond(transport, request, responseRPC, limit)
 }
 
-func sendResponse(conn *net.UDPConn, addr *net.UDPAddr, serializedResponse []byte) {
-	_, err := conn.WriteToUDP(serializedResponse, addr)
+// respond signs the response and sends it in the encoding of the request
+func (network *Network) respond(transport Transport, request incomingRequest, responseRPC RPC, limit int) {
+	stamp(&responseRPC)
+	if err := network.sign(&responseRPC); err != nil {
+		log.Printf("Response error: %v", err)
+		return
+	}
+	serializedRPC, err := request.codec.Encode(responseRPC)
+	if err != nil {
+		log.Printf("Response error: %v", err)
+		return
+	}
+
+	sendResponse(transport, request.from, serializedRPC, limit)
+}
+
+func sendResponse(transport Transport, address string, serializedResponse []byte, limit int) {
+	err := writeMessage(transport, address, serializedResponse, limit)
 	if err != nil {
 		log.Printf("Couldn't send response: %v", err)
 	}
 }
 
-func (network *Network) sendRPC(contact *Contact, rpcData []byte) (*net.UDPConn, error) {
-	ipAddress, port, err := net.SplitHostPort(contact.Address)
+// sendRPC writes the request to the contact from the node's listening
+// transport. If Serve has not bound it yet we wait for it at most timeout.
+func (network *Network) sendRPC(contact *Contact, rpcData []byte, timeout time.Duration) error {
+	_, port, err := net.SplitHostPort(contact.Address)
 	if err != nil {
 		log.Printf("Error: %v", err)
-		return nil, err
+		return err
 	}
 
-	parsedPort, err := strconv.Atoi(port)
+	_, err = strconv.Atoi(port)
 	if err != nil {
 		log.Printf("Error parsing port: %v", err)
-		return nil, err
-	}
-
-	nodeAddr := net.UDPAddr{
-		IP:   net.ParseIP(ipAddress),
-		Port: parsedPort,
+		return err
 	}
 
-	conn, err := net.DialUDP("udp", nil, &nodeAddr)
+	transport, err := network.Node.endpoint.waitReady(timeout)
 	if err != nil {
-		errorMessage := fmt.Sprintf("Error creating UDP connection: %v", err)
-		log.Print(errorMessage)
-		return nil, fmt.Errorf(errorMessage)
+		return err
 	}
 
-	_, err = conn.Write(rpcData)
+	err = writeMessage(transport, contact.Address, rpcData, maxMessageSize(network.Node.Datastore.MaxValueSize))
 	if err != nil {
 		log.Printf("Error writing data: %v", err)
-		conn.Close()
-		return nil, err
+		return err
 	}
 
-	return conn, nil
+	return nil
 }
 
 func Validate(request RPC, response RPC) bool {
@@ -109,31 +331,15 @@ func Validate(request RPC, response RPC) bool {
 	if *request.RpcID != *response.RpcID {
 		return false // RPCID in request does not match the one in response
 	}
-	switch request.Type {
-	case "PingRequest":
-		if response.Type == "PingResponse" {
-			return true
-		}
-	case "StoreRequest":
-		if response.Type == "StoreResponse" {
-			return true
-		}
-	case "FindContactRequest":
-		if response.Type == "FindContactResponse" {
-			return true
-		}
-	case "FindDataRequest":
-		if response.Type == "FindDataResponse" {
-			return true
-		}
 
-	case "RequestRequest":
-		if response.Type == "RequestResponse" {
-			return true
-		}
+	// Any request may be answered with a refusal, either because the node
+	// does not understand it or because handling it failed
+	if response.Type == "UnsupportedResponse" || response.Type == "ErrorResponse" {
+		return true
 	}
 
-	return false
+	kind, found := lookupRequest(request.Type)
+	return found && response.Type == kind.ResponseType
 }
 
 func (network *Network) SendPingMessage(contact *Contact) (*KademliaID, error) {
@@ -145,7 +351,7 @@ func (network *Network) SendPingMessage(contact *Contact) (*KademliaID, error) {
 
 	marshalledData, err := json.Marshal(pingRequest)
 	if err != nil {
-		return nil, fmt.Errorf("unable to marshal the data: %v", err)
+		return nil, fmt.Errorf("%w: %v", ErrEncode, err)
 	}
 
 	requestRPC := RPC{
@@ -167,7 +373,7 @@ func (network *Network) SendPingMessage(contact *Contact) (*KademliaID, error) {
 
 	pingResp, ok := pingResponse.(PingResponse)
 	if !ok {
-		return nil, fmt.Errorf("expected PingResponse, but got %T", pingResp)
+		return nil, fmt.Errorf("%w: expected PingResponse, but got %T", ErrBadResponse, pingResponse)
 	}
 
 	log.Printf("PONG: %v", pingResp.PongID)
@@ -175,16 +381,34 @@ func (network *Network) SendPingMessage(contact *Contact) (*KademliaID, error) {
 	return pingResp.PongID, nil
 }
 
+// SendStoreMessage stores data on contact. Stores need a token from the
+// contact, which lookups collect; without one the contact is asked for it
+// first. A token the contact no longer accepts is replaced once.
 func (network *Network) SendStoreMessage(data []byte, contact *Contact) (string, error) {
 	key := utils.Hash(string(data))
+	keyLocation, err := network.sendStore(key, data, contact)
+	if isBadToken(err) {
+		network.Node.tokens.forget(contact.ID)
+		keyLocation, err = network.sendStore(key, data, contact)
+	}
+	return keyLocation, err
+}
+
+func (network *Network) sendStore(key string, data []byte, contact *Contact) (string, error) {
+	token, err := network.storeToken(contact, key)
+	if err != nil {
+		return "", err
+	}
+
 	storeReq := StoreRequest{
-		Key:  key,
-		Data: string(data),
+		Key:   key,
+		Data:  string(data),
+		Token: token,
 	}
 
 	requestData, err := json.Marshal(storeReq)
 	if err != nil {
-		return "", fmt.Errorf("unable to marshal the data: %v", err)
+		return "", fmt.Errorf("%w: %v", ErrEncode, err)
 	}
 
 	requestRPC := RPC{
@@ -206,7 +430,7 @@ func (network *Network) SendStoreMessage(data []byte, contact *Contact) (string,
 
 	storeResp, ok := storeResponse.(StoreResponse)
 	if !ok {
-		return "", fmt.Errorf("expected StoreResponse, but got %T", storeResp)
+		return "", fmt.Errorf("%w: expected StoreResponse, but got %T", ErrBadResponse, storeResponse)
 	}
 
 	return storeResp.KeyLocation, nil
@@ -219,7 +443,7 @@ func (network *Network) SendFindContactMessage(contact *Contact, target *Kademli
 
 	requestData, err := json.Marshal(findContactReq)
 	if err != nil {
-		return nil, fmt.Errorf("unable to marshal the data: %v", err)
+		return nil, fmt.Errorf("%w: %v", ErrEncode, err)
 	}
 
 	requestRPC := RPC{
@@ -241,10 +465,18 @@ func (network *Network) SendFindContactMessage(contact *Contact, target *Kademli
 
 	findContactResp, ok := findContactResponse.(FindContactResponse)
 	if !ok {
-		return nil, fmt.Errorf("expected FindContactResponse, but got %T", findContactResponse)
+		return nil, fmt.Errorf("%w: expected FindContactResponse, but got %T", ErrBadResponse, findContactResponse)
 	}
 
-	contacts := findContactResp.Contacts
+	// Distances are not trusted from the wire, we calculate them ourselves.
+	// Contacts with IDs that could not have been made honestly are skipped.
+	network.Node.tokens.remember(response.Sender.ID, findContactResp.Token)
+
+	contacts := network.PuzzleDifficulty().filterContacts(findContactResp.Contacts)
+	for i := range contacts {
+		contacts[i].CalcDistance(target)
+	}
+	network.learnContacts(contacts)
 
 	return contacts, nil
 }
@@ -256,7 +488,7 @@ func (network *Network) SendFindDataMessage(contact *Contact, hash string) ([]by
 
 	requestData, err := json.Marshal(findDataReq)
 	if err != nil {
-		return nil, nil, Contact{}, fmt.Errorf("unable to marshal the data: %v", err)
+		return nil, nil, Contact{}, fmt.Errorf("%w: %v", ErrEncode, err)
 	}
 
 	requestRPC := RPC{
@@ -279,10 +511,18 @@ func (network *Network) SendFindDataMessage(contact *Contact, hash string) ([]by
 
 	findDataResp, ok := findDataResponse.(FindDataResponse)
 	if !ok {
-		return nil, nil, Contact{}, fmt.Errorf("expected FindDataResponse, but got %T", findDataResponse)
+		return nil, nil, Contact{}, fmt.Errorf("%w: expected FindDataResponse, but got %T", ErrBadResponse, findDataResponse)
 	}
 
+	network.Node.tokens.remember(response.Sender.ID, findDataResp.Token)
+
 	retreivedData := findDataResp.Data
+	hashID := NewKademliaID(hash)
+	findDataResp.Nodes = network.PuzzleDifficulty().filterContacts(findDataResp.Nodes)
+	for i := range findDataResp.Nodes {
+		findDataResp.Nodes[i].CalcDistance(hashID)
+	}
+	network.learnContacts(findDataResp.Nodes)
 
 	return retreivedData, findDataResp.Nodes, response.Sender, nil
 }
@@ -294,7 +534,7 @@ func (network *Network) SendRefreshMessage(contact *Contact, hash string) (Conta
 
 	requestData, err := json.Marshal(refreshReq)
 	if err != nil {
-		return Contact{}, fmt.Errorf("unable to marshal the data: %v", err)
+		return Contact{}, fmt.Errorf("%w: %v", ErrEncode, err)
 	}
 
 	requestRPC := RPC{
@@ -317,8 +557,40 @@ func (network *Network) SendRefreshMessage(contact *Contact, hash string) (Conta
 
 	refreshResp, ok := refreshResponse.(RefreshResponse)
 	if !ok {
-		return Contact{}, fmt.Errorf("expected RefreshResponse, but got %T", refreshResponse)
+		return Contact{}, fmt.Errorf("%w: expected RefreshResponse, but got %T", ErrBadResponse, refreshResponse)
 	}
 
 	return refreshResp.Node, nil
 }
+
+// SendNodeInfoMessage asks the contact for its protocol version, capabilities and uptime
+func (network *Network) SendNodeInfoMessage(contact *Contact) (NodeInfoResponse, error) {
+	requestData, err := json.Marshal(NodeInfoRequest{})
+	if err != nil {
+		return NodeInfoResponse{}, fmt.Errorf("%w: %v", ErrEncode, err)
+	}
+
+	requestRPC := RPC{
+		Type:   "NodeInfoRequest",
+		Sender: network.Node.Self,
+		RpcID:  NewRandomKademliaID(),
+		Data:   json.RawMessage(requestData),
+	}
+
+	response, err := network.HandleResponseRPC(contact, requestRPC)
+	if err != nil {
+		return NodeInfoResponse{}, err
+	}
+
+	nodeInfoResponse, err := network.ExtractResponseData(response)
+	if err != nil {
+		return NodeInfoResponse{}, err
+	}
+
+	nodeInfoResp, ok := nodeInfoResponse.(NodeInfoResponse)
+	if !ok {
+		return NodeInfoResponse{}, fmt.Errorf("%w: expected NodeInfoResponse, but got %T", ErrBadResponse, nodeInfoResponse)
+	}
+
+	return nodeInfoResp, nil
+}
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -41,6 +42,11 @@ func TestValidate(t *testing.T) {
 			Response: RPC{Type: "FindDataResponse", RpcID: requestID},
 			Expected: true,
 		},
+		{
+			Request:  RPC{Type: "RefreshRequest", RpcID: requestID},
+			Response: RPC{Type: "RefreshResponse", RpcID: requestID},
+			Expected: true,
+		},
 		// Invalid cases
 		{
 			Request:  RPC{Type: "PingRequest", RpcID: requestID},
@@ -82,17 +88,17 @@ func TestSendPingMessage(t *testing.T) {
 	bootstrapNetwork.Node = &bootstrapNode
 
 	// Start listening on the bootstrap node's address
-	go bootstrapNetwork.Listen("127.0.0.1", 1351)
+	go bootstrapNetwork.Listen(context.Background(), "127.0.0.1", 1351)
 
 	// Create a simulated network for the second node
 	secondNetwork := &Network{}
 	secondNetwork.Node = &secondNode
 
 	// Start listening on the second node's address
-	go secondNetwork.Listen("127.0.0.1", 1352)
+	go secondNetwork.Listen(context.Background(), "127.0.0.1", 1352)
 
 	// Perform the join operation for the second node
-	_ = secondNode.JoinNetwork(&bootstrapNode.Self)
+	_ = secondNode.JoinNetwork(context.Background(), &bootstrapNode.Self)
 
 	// Create a contact for the second node
 	contact := Contact{
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// How many contacts may wait for their verifying ping at once. Contacts
+// learned while the queue is full are forgotten; lookups keep turning them up.
+const pendingQueueSize = 64
+
+// pendingContacts is a queue of contacts waiting for a ping. The node keeps
+// one for the contacts other nodes told us about in their responses. Anyone
+// can put any ID and address into a FindContactResponse, so such contacts
+// only enter a k-bucket after answering a ping themselves: the signed answer
+// proves the ID and arrives from the real address. Another one holds the
+// contacts that may have to make room in a full bucket, see checkEvictions.
+type pendingContacts struct {
+	mu       sync.Mutex
+	contacts map[KademliaID]Contact
+	queue    chan Contact
+}
+
+func newPendingContacts() *pendingContacts {
+	return &pendingContacts{
+		contacts: make(map[KademliaID]Contact),
+		queue:    make(chan Contact, pendingQueueSize),
+	}
+}
+
+// add queues contacts for verification unless they are queued already
+func (pending *pendingContacts) add(contacts ...Contact) {
+	pending.mu.Lock()
+	defer pending.mu.Unlock()
+
+	for _, contact := range contacts {
+		if contact.ID == nil {
+			continue
+		}
+		if _, found := pending.contacts[*contact.ID]; found {
+			continue
+		}
+
+		select {
+		case pending.queue <- contact:
+			pending.contacts[*contact.ID] = contact
+		default:
+		}
+	}
+}
+
+func (pending *pendingContacts) done(contact Contact) {
+	pending.mu.Lock()
+	defer pending.mu.Unlock()
+
+	delete(pending.contacts, *contact.ID)
+}
+
+// Pending returns the contacts waiting to answer their verifying ping
+func (network *Network) Pending() []Contact {
+	pending := network.Node.pending
+	pending.mu.Lock()
+	defer pending.mu.Unlock()
+
+	contacts := make([]Contact, 0, len(pending.contacts))
+	for _, contact := range pending.contacts {
+		contacts = append(contacts, contact)
+	}
+	return contacts
+}
+
+// learnContacts queues the contacts from a response for verification,
+// skipping ourselves and the contacts already in the routing table
+func (network *Network) learnContacts(contacts []Contact) {
+	var unknown []Contact
+	for _, contact := range contacts {
+		if contact.ID == nil || contact.ID.Equals(network.Node.Self.ID) {
+			continue
+		}
+		if network.Node.Routes.Contains(contact.ID) {
+			continue
+		}
+		unknown = append(unknown, contact)
+	}
+	network.Node.pending.add(unknown...)
+}
+
+// verifyPending pings the pending contacts one by one until ctx is done. A
+// contact that answers is added to the routing table by HandleResponseRPC,
+// with the ID and address the answer came with.
+func (network *Network) verifyPending(ctx context.Context) {
+	pending := network.Node.pending
+	for {
+		select {
+		case contact := <-pending.queue:
+			if !network.Node.Routes.Contains(contact.ID) {
+				if _, err := network.SendPingMessage(&contact); err != nil {
+					log.Printf("Pending contact %v did not answer: %v", contact.Address, err)
+				}
+			}
+			pending.done(contact)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSenderAddressFromSource(t *testing.T) {
+	switchboard := NewSwitchboard()
+	node := startMemoryNode(t, switchboard, "10.5.0.1:1337")
+	transport, _ := switchboard.Listen("10.5.0.2:1337")
+	defer transport.Close()
+
+	// The sender claims to be somewhere else than it sends from
+	sender := NewKademliaNode("10.5.0.99:1337")
+	encoded, _ := JSONCodec{}.Encode(signedPing(t, &sender))
+	assert.NoError(t, transport.Send(node.Self.Address, encoded))
+
+	buffer := make([]byte, maxDatagramSize)
+	_, _, err := transport.Receive(buffer)
+	assert.NoError(t, err, "The answer goes to the source address")
+
+	contacts := node.Routes.FindClosestContacts(sender.Self.ID, 1)
+	assert.Len(t, contacts, 1)
+	assert.Equal(t, sender.Self.ID, contacts[0].ID)
+	assert.Equal(t, "10.5.0.2:1337", contacts[0].Address)
+}
+
+func TestContactsFromResponsesArePending(t *testing.T) {
+	switchboard := NewSwitchboard()
+	first := startMemoryNode(t, switchboard, "10.5.1.1:1337")
+	second := startMemoryNode(t, switchboard, "10.5.1.2:1337")
+	third := startMemoryNode(t, switchboard, "10.5.1.3:1337")
+
+	network := &Network{Node: first}
+	network.SetRetryPolicy("PingRequest", RetryPolicy{Timeout: 50 * time.Millisecond})
+
+	// The second node knows the third one and a contact nobody answers for
+	fake := NewContact(NewRandomKademliaID(), "10.5.1.4:1337")
+	second.Routes.AddContact(third.Self)
+	second.Routes.AddContact(fake)
+
+	contacts, err := network.SendFindContactMessage(&second.Self, third.Self.ID)
+	assert.NoError(t, err)
+	assert.Len(t, contacts, 3, "The third node, the fake one and ourselves")
+
+	// Only the contact that answered its ping enters the routing table
+	assert.Eventually(t, func() bool {
+		return first.Routes.Contains(third.Self.ID) && len(network.Pending()) == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.False(t, first.Routes.Contains(fake.ID))
+	assert.True(t, first.Routes.Contains(second.Self.ID), "The responder itself is known to be alive")
+}
@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sync"
+)
+
+// ErrPuzzleFailed is returned for node IDs that do not solve the crypto
+// puzzles the network requires
+var ErrPuzzleFailed = errors.New("node ID does not solve the crypto puzzle")
+
+// PuzzleDifficulty sets how expensive node IDs are to make, as in S/Kademlia.
+// Each difficulty is a number of leading zero bits, and zero turns the
+// puzzle off.
+//
+// The static puzzle requires the hash of the node ID to start with Static
+// zero bits. The ID itself comes from the public key, so the only way to
+// solve it is generating keys until one fits, which makes it expensive to
+// get many IDs and impossible to pick one. The dynamic puzzle requires a
+// nonce X for which the hash of ID xor X starts with Dynamic zero bits; it
+// is carried in every RPC and can be made harder later without new IDs.
+type PuzzleDifficulty struct {
+	Static  int
+	Dynamic int
+}
+
+type puzzleSettings struct {
+	mu         sync.Mutex
+	difficulty PuzzleDifficulty
+}
+
+// SetPuzzleDifficulty sets the puzzles every contact has to solve. All nodes
+// of a network should use the same difficulty, and the node's own identity
+// has to be generated with at least that difficulty.
+func (network *Network) SetPuzzleDifficulty(difficulty PuzzleDifficulty) {
+	settings := network.Node.puzzle
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+
+	settings.difficulty = difficulty
+}
+
+// PuzzleDifficulty returns the puzzles every contact has to solve
+func (network *Network) PuzzleDifficulty() PuzzleDifficulty {
+	settings := network.Node.puzzle
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+
+	return settings.difficulty
+}
+
+// checkStatic verifies the static puzzle, the only one that can be checked
+// for contacts we only know the ID of
+func (difficulty PuzzleDifficulty) checkStatic(id *KademliaID) error {
+	if difficulty.Static == 0 {
+		return nil
+	}
+	if id == nil || leadingZeros(sha1.Sum(id[:])) < difficulty.Static {
+		return fmt.Errorf("%w: static puzzle", ErrPuzzleFailed)
+	}
+	return nil
+}
+
+// check verifies both puzzles for the sender of an RPC
+func (difficulty PuzzleDifficulty) check(id *KademliaID, nonce *KademliaID) error {
+	if err := difficulty.checkStatic(id); err != nil {
+		return err
+	}
+	if difficulty.Dynamic == 0 {
+		return nil
+	}
+	if id == nil || nonce == nil || leadingZeros(dynamicHash(id, nonce)) < difficulty.Dynamic {
+		return fmt.Errorf("%w: dynamic puzzle", ErrPuzzleFailed)
+	}
+	return nil
+}
+
+// filterContacts drops the contacts whose IDs fail the static puzzle
+func (difficulty PuzzleDifficulty) filterContacts(contacts []Contact) []Contact {
+	if difficulty.Static == 0 {
+		return contacts
+	}
+
+	valid := contacts[:0]
+	for _, contact := range contacts {
+		if difficulty.checkStatic(contact.ID) == nil {
+			valid = append(valid, contact)
+		}
+	}
+	return valid
+}
+
+// solveDynamic searches a nonce for the dynamic puzzle of id
+func solveDynamic(id *KademliaID, difficulty int) (*KademliaID, error) {
+	nonce := KademliaID{}
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, fmt.Errorf("solving dynamic puzzle: %w", err)
+	}
+
+	for leadingZeros(dynamicHash(id, &nonce)) < difficulty {
+		increment(&nonce)
+	}
+	return &nonce, nil
+}
+
+func dynamicHash(id *KademliaID, nonce *KademliaID) [sha1.Size]byte {
+	return sha1.Sum(id.CalcDistance(nonce)[:])
+}
+
+// increment adds one to the nonce, treating it as a big-endian number
+func increment(nonce *KademliaID) {
+	for i := IDLength - 1; i >= 0; i-- {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+func leadingZeros(hash [sha1.Size]byte) int {
+	zeros := 0
+	for _, b := range hash {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return zeros
+}
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testDifficulty = PuzzleDifficulty{Static: 8, Dynamic: 8}
+
+func TestLeadingZeros(t *testing.T) {
+	assert.Equal(t, 160, leadingZeros([sha1.Size]byte{}))
+	assert.Equal(t, 0, leadingZeros([sha1.Size]byte{0x80}))
+	assert.Equal(t, 11, leadingZeros([sha1.Size]byte{0, 0x10}))
+}
+
+func TestGeneratePuzzleIdentity(t *testing.T) {
+	identity, err := GenerateIdentity(testDifficulty)
+	assert.NoError(t, err)
+	assert.NoError(t, testDifficulty.check(identity.ID(), identity.Nonce))
+
+	// The nonce does not solve a much harder dynamic puzzle, an arbitrary ID
+	// almost never solves the static one
+	assert.ErrorIs(t, PuzzleDifficulty{Dynamic: 128}.check(identity.ID(), identity.Nonce), ErrPuzzleFailed)
+	assert.ErrorIs(t, PuzzleDifficulty{Dynamic: 1}.check(identity.ID(), nil), ErrPuzzleFailed)
+	assert.ErrorIs(t, PuzzleDifficulty{Static: 32}.check(identity.ID(), nil), ErrPuzzleFailed)
+
+	// Without puzzles every ID is fine
+	assert.NoError(t, PuzzleDifficulty{}.check(NewRandomKademliaID(), nil))
+}
+
+func TestLoadPuzzleIdentity(t *testing.T) {
+	dataDir := t.TempDir()
+	identity, err := LoadIdentity(dataDir, testDifficulty)
+	assert.NoError(t, err)
+
+	// The nonce is saved with the key
+	reloaded, err := LoadIdentity(dataDir, testDifficulty)
+	assert.NoError(t, err)
+	assert.Equal(t, identity.Nonce, reloaded.Nonce)
+
+	// A harder dynamic puzzle is solved again for the same ID
+	harder := PuzzleDifficulty{Static: 8, Dynamic: 12}
+	reloaded, err = LoadIdentity(dataDir, harder)
+	assert.NoError(t, err)
+	assert.Equal(t, identity.ID(), reloaded.ID())
+	assert.NoError(t, harder.check(reloaded.ID(), reloaded.Nonce))
+
+	// The static puzzle can not be solved without a new ID
+	_, err = LoadIdentity(dataDir, PuzzleDifficulty{Static: 40})
+	assert.ErrorIs(t, err, ErrPuzzleFailed)
+}
+
+func startPuzzleNode(t *testing.T, switchboard *Switchboard, address string) *Kademlia {
+	identity, err := GenerateIdentity(testDifficulty)
+	assert.NoError(t, err)
+	node := NewKademliaNodeWithIdentity(address, identity)
+	network := &Network{Node: &node}
+	network.SetPuzzleDifficulty(testDifficulty)
+
+	transport, err := switchboard.Listen(address)
+	assert.NoError(t, err)
+	go network.Serve(context.Background(), transport)
+	t.Cleanup(func() { node.Close() })
+	return &node
+}
+
+func TestPuzzleCheckedOnIncomingContacts(t *testing.T) {
+	switchboard := NewSwitchboard()
+	first := startPuzzleNode(t, switchboard, "10.3.0.1:1337")
+	second := startPuzzleNode(t, switchboard, "10.3.0.2:1337")
+
+	// Nodes that solved the puzzles talk to each other
+	_, err := (&Network{Node: first}).SendPingMessage(&second.Self)
+	assert.NoError(t, err)
+	assert.Len(t, second.Routes.FindClosestContacts(first.Self.ID, 1), 1)
+
+	// A node with a free ID is ignored, so its ping times out
+	var cheapIdentity *Identity
+	for cheapIdentity == nil || testDifficulty.checkStatic(cheapIdentity.ID()) == nil {
+		cheapIdentity, _ = GenerateIdentity(PuzzleDifficulty{})
+	}
+	cheapNode := NewKademliaNodeWithIdentity("10.3.0.3:1337", cheapIdentity)
+	cheap := &cheapNode
+	cheapNetwork := &Network{Node: cheap}
+	cheapTransport, _ := switchboard.Listen(cheap.Self.Address)
+	go cheapNetwork.Serve(context.Background(), cheapTransport)
+	defer cheap.Close()
+	cheapNetwork.SetRetryPolicy("PingRequest", RetryPolicy{Timeout: 100 * time.Millisecond})
+	_, err = cheapNetwork.SendPingMessage(&second.Self)
+	assert.ErrorIs(t, err, ErrTimeout)
+	for _, contact := range second.Routes.FindClosestContacts(cheap.Self.ID, bucketSize) {
+		assert.NotEqual(t, cheap.Self.ID, contact.ID)
+	}
+
+	// Contacts in responses that fail the static puzzle are left out
+	first.Routes.AddContact(cheap.Self)
+	contacts, err := (&Network{Node: second}).SendFindContactMessage(&first.Self, cheap.Self.ID)
+	assert.NoError(t, err)
+	for _, contact := range contacts {
+		assert.NotEqual(t, cheap.Self.ID, contact.ID)
+	}
+}
+
+func TestPuzzleNonceInBinaryCodec(t *testing.T) {
+	identity, _ := GenerateIdentity(testDifficulty)
+	node := NewKademliaNodeWithIdentity("127.0.0.1:1337", identity)
+
+	pingData, _ := json.Marshal(PingRequest{PingID: NewRandomKademliaID()})
+	rpc := RPC{Type: "PingRequest", Sender: node.Self, RpcID: NewRandomKademliaID(), Data: pingData}
+	stamp(&rpc)
+	assert.NoError(t, (&Network{Node: &node}).sign(&rpc))
+
+	encoded, err := BinaryCodec{}.Encode(rpc)
+	assert.NoError(t, err)
+	decoded, err := BinaryCodec{}.Decode(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, identity.Nonce, decoded.PuzzleNonce)
+	assert.NoError(t, verify(decoded))
+}
@@ -0,0 +1,271 @@
+package internal
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket: Burst requests may arrive at once, after that
+// Rate per second. A zero Rate turns the limit off.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimits configures what a node accepts from the network. Messages over
+// the global or per-IP limit and requests over the limit of their type are
+// dropped like lost datagrams. Every dropped message and every message that
+// can not be read or verified counts as a violation, and a source with more
+// than BanAfter violations within a minute is ignored completely for BanTime.
+type RateLimits struct {
+	Global   RateLimit            // All incoming messages together
+	PerIP    RateLimit            // Messages from one source IP
+	PerType  map[string]RateLimit // Requests of one type from one source IP
+	BanAfter int                  // Zero never bans
+	BanTime  time.Duration
+}
+
+// DefaultRateLimits leave plenty of room for lookups, but keep a single peer
+// from filling the datastore
+var DefaultRateLimits = RateLimits{
+	Global: RateLimit{Rate: 2000, Burst: 4000},
+	PerIP:  RateLimit{Rate: 100, Burst: 200},
+	PerType: map[string]RateLimit{
+		"StoreRequest": {Rate: 10, Burst: 20},
+	},
+	BanAfter: 100,
+	BanTime:  5 * time.Minute,
+}
+
+// Violations are forgotten and idle buckets dropped this often
+const sweepInterval = time.Minute
+
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the last call
+func (bucket *tokenBucket) refill(now time.Time) {
+	bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.limit.Rate
+	if bucket.tokens > float64(bucket.limit.Burst) {
+		bucket.tokens = float64(bucket.limit.Burst)
+	}
+	bucket.last = now
+}
+
+// take removes a token if there is one
+func (bucket *tokenBucket) take(now time.Time) bool {
+	bucket.refill(now)
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// full reports whether the bucket is back where a new one would start
+func (bucket *tokenBucket) full(now time.Time) bool {
+	bucket.refill(now)
+	return bucket.tokens >= float64(bucket.limit.Burst)
+}
+
+type rateLimiter struct {
+	mu         sync.Mutex
+	limits     RateLimits
+	global     *tokenBucket
+	perIP      map[string]*tokenBucket
+	perType    map[string]*tokenBucket // Keyed by source IP and RPC type
+	violations map[string]int
+	bans       map[string]time.Time // Source IP to end of the ban
+	lastSweep  time.Time
+	now        func() time.Time
+
+	limited   uint64
+	malformed uint64
+	ignored   uint64
+}
+
+func newRateLimiter() *rateLimiter {
+	limiter := &rateLimiter{now: time.Now}
+	limiter.reset(DefaultRateLimits)
+	return limiter
+}
+
+// reset starts over with new limits, full buckets and no bans
+func (limiter *rateLimiter) reset(limits RateLimits) {
+	limiter.limits = limits
+	limiter.global = limiter.newBucket(limits.Global)
+	limiter.perIP = make(map[string]*tokenBucket)
+	limiter.perType = make(map[string]*tokenBucket)
+	limiter.violations = make(map[string]int)
+	limiter.bans = make(map[string]time.Time)
+	limiter.lastSweep = limiter.now()
+}
+
+func (limiter *rateLimiter) newBucket(limit RateLimit) *tokenBucket {
+	return &tokenBucket{limit: limit, tokens: float64(limit.Burst), last: limiter.now()}
+}
+
+// SetRateLimits replaces the limits on incoming requests. Current bans are
+// lifted.
+func (network *Network) SetRateLimits(limits RateLimits) {
+	limiter := network.Node.limiter
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	limiter.reset(limits)
+}
+
+// RateLimits returns the limits on incoming requests
+func (network *Network) RateLimits() RateLimits {
+	limiter := network.Node.limiter
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	return limiter.limits
+}
+
+// Banned returns the source IPs that are currently ignored
+func (network *Network) Banned() []string {
+	limiter := network.Node.limiter
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	var banned []string
+	now := limiter.now()
+	for ip, until := range limiter.bans {
+		if now.Before(until) {
+			banned = append(banned, ip)
+		}
+	}
+	return banned
+}
+
+// sourceIP returns the IP of a source address, which limits and bans apply to
+func sourceIP(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
+
+// banned reports whether messages from ip are to be ignored
+func (limiter *rateLimiter) banned(ip string) bool {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	until, found := limiter.bans[ip]
+	if !found {
+		return false
+	}
+	if !limiter.now().Before(until) {
+		delete(limiter.bans, ip)
+		return false
+	}
+	limiter.ignored++
+	return true
+}
+
+// admit takes a token for a message from ip from the per-IP and the global
+// bucket. It runs before the message is decoded, so a flood costs us little
+// more than counting it.
+func (limiter *rateLimiter) admit(ip string) bool {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := limiter.now()
+	limiter.sweep(now)
+
+	allowed := limiter.takeFrom(limiter.limits.PerIP, limiter.perIP, ip, now)
+	if limiter.limits.Global.Rate > 0 && allowed {
+		allowed = limiter.global.take(now)
+	}
+	if !allowed {
+		limiter.drop(ip, now)
+	}
+	return allowed
+}
+
+// allowType takes a token for a request from the bucket of its type, if the
+// type has a limit of its own
+func (limiter *rateLimiter) allowType(ip string, rpcType string) bool {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	limit, found := limiter.limits.PerType[rpcType]
+	if !found {
+		return true
+	}
+
+	now := limiter.now()
+	allowed := limiter.takeFrom(limit, limiter.perType, ip+" "+rpcType, now)
+	if !allowed {
+		limiter.drop(ip, now)
+	}
+	return allowed
+}
+
+// drop records a message from ip that was over a limit
+func (limiter *rateLimiter) drop(ip string, now time.Time) {
+	limiter.limited++
+	limiter.violation(ip, now)
+}
+
+func (limiter *rateLimiter) takeFrom(limit RateLimit, buckets map[string]*tokenBucket, key string, now time.Time) bool {
+	if limit.Rate <= 0 {
+		return true
+	}
+
+	bucket, found := buckets[key]
+	if !found {
+		bucket = limiter.newBucket(limit)
+		buckets[key] = bucket
+	}
+	return bucket.take(now)
+}
+
+// reject records a message from ip that could not be read or verified
+func (limiter *rateLimiter) reject(ip string) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	limiter.malformed++
+	limiter.violation(ip, limiter.now())
+}
+
+func (limiter *rateLimiter) violation(ip string, now time.Time) {
+	limiter.violations[ip]++
+	if limiter.limits.BanAfter > 0 && limiter.violations[ip] > limiter.limits.BanAfter {
+		log.Printf("Banning %v for %v", ip, limiter.limits.BanTime)
+		limiter.bans[ip] = now.Add(limiter.limits.BanTime)
+		delete(limiter.violations, ip)
+	}
+}
+
+// sweep forgets old violations, expired bans and buckets that have filled
+// up again, so sources that stopped sending take no memory
+func (limiter *rateLimiter) sweep(now time.Time) {
+	if now.Sub(limiter.lastSweep) < sweepInterval {
+		return
+	}
+	limiter.lastSweep = now
+
+	limiter.violations = make(map[string]int)
+	for ip, until := range limiter.bans {
+		if !now.Before(until) {
+			delete(limiter.bans, ip)
+		}
+	}
+	for _, buckets := range []map[string]*tokenBucket{limiter.perIP, limiter.perType} {
+		for key, bucket := range buckets {
+			if bucket.full(now) {
+				delete(buckets, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testLimiter returns a limiter on a clock that only moves when told to
+func testLimiter(limits RateLimits) (*rateLimiter, *time.Time) {
+	now := time.Now()
+	limiter := &rateLimiter{now: func() time.Time { return now }}
+	limiter.reset(limits)
+	return limiter, &now
+}
+
+func TestRateLimitPerIP(t *testing.T) {
+	limiter, now := testLimiter(RateLimits{PerIP: RateLimit{Rate: 1, Burst: 2}})
+
+	assert.True(t, limiter.admit("10.0.0.1"))
+	assert.True(t, limiter.admit("10.0.0.1"))
+	assert.False(t, limiter.admit("10.0.0.1"))
+
+	// Other sources have buckets of their own
+	assert.True(t, limiter.admit("10.0.0.2"))
+
+	// Tokens come back with time
+	*now = now.Add(time.Second)
+	assert.True(t, limiter.admit("10.0.0.1"))
+	assert.False(t, limiter.admit("10.0.0.1"))
+	assert.Equal(t, uint64(2), limiter.limited)
+}
+
+func TestRateLimitPerType(t *testing.T) {
+	limiter, now := testLimiter(RateLimits{
+		PerType: map[string]RateLimit{"StoreRequest": {Rate: 1, Burst: 2}},
+	})
+
+	// Stores run out, types without a limit of their own do not
+	assert.True(t, limiter.allowType("10.0.0.1", "StoreRequest"))
+	assert.True(t, limiter.allowType("10.0.0.1", "StoreRequest"))
+	assert.False(t, limiter.allowType("10.0.0.1", "StoreRequest"))
+	for i := 0; i < 10; i++ {
+		assert.True(t, limiter.allowType("10.0.0.1", "PingRequest"))
+	}
+
+	// Other sources have buckets of their own
+	assert.True(t, limiter.allowType("10.0.0.2", "StoreRequest"))
+
+	*now = now.Add(time.Second)
+	assert.True(t, limiter.allowType("10.0.0.1", "StoreRequest"))
+	assert.False(t, limiter.allowType("10.0.0.1", "StoreRequest"))
+	assert.Equal(t, uint64(2), limiter.limited)
+}
+
+func TestRateLimitGlobal(t *testing.T) {
+	limiter, _ := testLimiter(RateLimits{Global: RateLimit{Rate: 1, Burst: 3}})
+
+	assert.True(t, limiter.admit("10.0.0.1"))
+	assert.True(t, limiter.admit("10.0.0.2"))
+	assert.True(t, limiter.admit("10.0.0.3"))
+	assert.False(t, limiter.admit("10.0.0.4"))
+}
+
+func TestBanAfterViolations(t *testing.T) {
+	limiter, now := testLimiter(RateLimits{
+		PerIP:    RateLimit{Rate: 1, Burst: 1},
+		BanAfter: 2,
+		BanTime:  time.Minute,
+	})
+
+	assert.True(t, limiter.admit("10.0.0.1"))
+	assert.False(t, limiter.admit("10.0.0.1"))
+	limiter.reject("10.0.0.1")
+	assert.False(t, limiter.banned("10.0.0.1"))
+
+	// The third violation gets the source banned
+	limiter.reject("10.0.0.1")
+	assert.True(t, limiter.banned("10.0.0.1"))
+	assert.False(t, limiter.banned("10.0.0.2"))
+
+	*now = now.Add(time.Minute)
+	assert.False(t, limiter.banned("10.0.0.1"))
+}
+
+func TestRateLimitedNode(t *testing.T) {
+	switchboard := NewSwitchboard()
+	node := startMemoryNode(t, switchboard, "10.6.0.1:1337")
+	sender := startMemoryNode(t, switchboard, "10.6.0.2:1337")
+
+	nodeNetwork := &Network{Node: node}
+	nodeNetwork.SetRateLimits(RateLimits{
+		PerIP:    RateLimit{Rate: 0.001, Burst: 3},
+		BanAfter: 3,
+		BanTime:  time.Minute,
+	})
+
+	senderNetwork := &Network{Node: sender}
+	senderNetwork.SetRetryPolicy("PingRequest", RetryPolicy{Timeout: 50 * time.Millisecond})
+	for i := 0; i < 3; i++ {
+		_, err := senderNetwork.SendPingMessage(&node.Self)
+		assert.NoError(t, err)
+	}
+	_, err := senderNetwork.SendPingMessage(&node.Self)
+	assert.ErrorIs(t, err, ErrTimeout)
+
+	// Without tokens even garbage is dropped before it is parsed
+	transport, _ := switchboard.Listen("10.6.0.2:1338")
+	defer transport.Close()
+	assert.NoError(t, transport.Send(node.Self.Address, []byte("garbage")))
+
+	assert.Eventually(t, func() bool {
+		stats := nodeNetwork.Stats()
+		return stats.RateLimited == 2 && stats.Malformed == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// Two more violations and the sender is banned
+	assert.NoError(t, transport.Send(node.Self.Address, []byte("garbage")))
+	assert.NoError(t, transport.Send(node.Self.Address, []byte("garbage")))
+	assert.Eventually(t, func() bool {
+		return nodeNetwork.Stats().BannedPeers == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"10.6.0.2"}, nodeNetwork.Banned())
+}
+
+func TestRateLimitBeforeVerification(t *testing.T) {
+	switchboard := NewSwitchboard()
+	node := startMemoryNode(t, switchboard, "10.14.0.1:1337")
+	forger := NewKademliaNode("10.14.0.2:1337")
+
+	nodeNetwork := &Network{Node: node}
+	nodeNetwork.SetRateLimits(RateLimits{
+		PerIP:    RateLimit{Rate: 0.001, Burst: 1},
+		BanAfter: 10,
+		BanTime:  time.Minute,
+	})
+
+	transport, _ := switchboard.Listen(forger.Self.Address)
+	defer transport.Close()
+	for i := 0; i < 3; i++ {
+		forged := signedPing(t, &forger)
+		forged.Signature[0] ^= 0xff
+		encoded, err := JSONCodec{}.Encode(forged)
+		assert.NoError(t, err)
+		assert.NoError(t, transport.Send(node.Self.Address, encoded))
+	}
+
+	// Only the message within the limit had its signature checked
+	assert.Eventually(t, func() bool {
+		stats := nodeNetwork.Stats()
+		return stats.Malformed == 1 && stats.RateLimited == 2
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// DefaultRefreshInterval is how long a bucket may go without a lookup or a
+// contact being seen before it is refreshed, as in the Kademlia paper
+const DefaultRefreshInterval = time.Hour
+
+// Idle buckets are looked for this many times per refresh interval, so no
+// bucket stays idle much longer than the interval
+const refreshChecks = 4
+
+type refreshSettings struct {
+	mu       sync.Mutex
+	interval time.Duration
+	changed  chan struct{} // Wakes the refresh loop up for a new interval
+}
+
+func newRefreshSettings() *refreshSettings {
+	return &refreshSettings{
+		interval: DefaultRefreshInterval,
+		changed:  make(chan struct{}, 1),
+	}
+}
+
+// SetRefreshInterval sets how long a bucket may be idle before the node
+// refreshes it with a lookup. Zero turns the refresh off, both the periodic
+// one and the one after joining the network.
+func (network *Network) SetRefreshInterval(interval time.Duration) {
+	settings := network.Node.refresh
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+
+	settings.interval = interval
+	select {
+	case settings.changed <- struct{}{}:
+	default:
+	}
+}
+
+// RefreshInterval returns how long a bucket may be idle before it is
+// refreshed
+func (network *Network) RefreshInterval() time.Duration {
+	settings := network.Node.refresh
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+
+	return settings.interval
+}
+
+// RefreshBuckets looks up a random ID in every bucket that was idle for at
+// least idle, which fills it with whatever nodes are in its range now and
+// tells them about us. The lookups run concurrently; it returns the number
+// of buckets refreshed once all of them are done.
+func (kademlia *Kademlia) RefreshBuckets(ctx context.Context, idle time.Duration) int {
+	indexes := kademlia.Routes.IdleBuckets(idle)
+	kademlia.refreshBuckets(ctx, indexes)
+	return len(indexes)
+}
+
+// refreshBuckets looks up a random ID in each of the buckets, at most alpha
+// of them at a time
+func (kademlia *Kademlia) refreshBuckets(ctx context.Context, indexes []int) {
+	var wg sync.WaitGroup
+	running := make(chan struct{}, alpha)
+	for _, index := range indexes {
+		target := kademlia.Routes.RandomIDInBucket(index)
+		running <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-running }()
+			kademlia.LookupContact(ctx, target)
+		}()
+	}
+	wg.Wait()
+}
+
+// refreshes reports whether buckets are refreshed at all, see
+// SetRefreshInterval
+func (settings *refreshSettings) refreshes() bool {
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+
+	return settings.interval > 0
+}
+
+// refreshLoop refreshes the idle buckets until ctx is done. A new interval
+// takes effect right away.
+func (network *Network) refreshLoop(ctx context.Context) {
+	changed := network.Node.refresh.changed
+	for {
+		interval := network.RefreshInterval()
+		var tick <-chan time.Time
+		if interval > 0 {
+			tick = time.After(interval / refreshChecks)
+		}
+
+		select {
+		case <-tick:
+		case <-changed:
+			continue
+		case <-ctx.Done():
+			return
+		}
+
+		if refreshed := network.Node.RefreshBuckets(ctx, interval); refreshed > 0 {
+			log.Printf("Refreshed %d idle buckets", refreshed)
+		}
+	}
+}
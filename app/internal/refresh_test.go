@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// makeIdle pretends nothing happened in any bucket since the time given
+func makeIdle(rt *RoutingTable, since time.Time) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	for _, bucket := range rt.buckets {
+		bucket.lastActivity = since
+	}
+}
+
+func lastActivity(rt *RoutingTable, index int) time.Time {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	return rt.buckets[index].lastActivity
+}
+
+func TestRandomIDInBucket(t *testing.T) {
+	rt := NewRoutingTable(NewContact(NewRandomKademliaID(), "localhost:8000"))
+	for _, index := range []int{0, 1, 7, 8, 100, IDLength*8 - 2} {
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, index, rt.getBucketIndex(rt.RandomIDInBucket(index)))
+		}
+	}
+}
+
+func TestIdleBuckets(t *testing.T) {
+	me := NewContact(NewRandomKademliaID(), "localhost:8000")
+	rt := NewRoutingTable(me)
+	assert.Empty(t, rt.IdleBuckets(0), "Nothing to refresh without contacts")
+
+	// We are never in our own table
+	rt.AddContact(me)
+	assert.False(t, rt.Contains(me.ID))
+
+	rt.AddContact(NewContact(rt.RandomIDInBucket(3), "localhost:8001"))
+	assert.Equal(t, []int{0, 1, 2, 3}, rt.IdleBuckets(0))
+	assert.Empty(t, rt.IdleBuckets(time.Hour))
+
+	// Buckets count as active when a contact is seen or looked up in them
+	makeIdle(rt, time.Now().Add(-2*time.Hour))
+	rt.AddContact(NewContact(rt.RandomIDInBucket(1), "localhost:8002"))
+	rt.Touch(rt.RandomIDInBucket(2))
+	assert.Equal(t, []int{0, 3}, rt.IdleBuckets(time.Hour))
+}
+
+func TestRefreshBuckets(t *testing.T) {
+	switchboard := NewSwitchboard()
+	bootstrap := startMemoryNode(t, switchboard, "10.11.0.1:1337")
+	var nodes []*Kademlia
+	for i := 2; i <= 10; i++ {
+		node := startMemoryNode(t, switchboard, fmt.Sprintf("10.11.0.%d:1337", i))
+		node.JoinNetwork(context.Background(), &bootstrap.Self)
+		nodes = append(nodes, node)
+	}
+
+	node := nodes[0]
+	makeIdle(node.Routes, time.Now().Add(-2*time.Hour))
+	refreshed := node.RefreshBuckets(context.Background(), time.Hour)
+	assert.Equal(t, node.Routes.closestBucket()+1, refreshed)
+	assert.Empty(t, node.Routes.IdleBuckets(time.Hour))
+}
+
+func TestPeriodicRefresh(t *testing.T) {
+	switchboard := NewSwitchboard()
+	bootstrap := startMemoryNode(t, switchboard, "10.11.1.1:1337")
+	node := startMemoryNode(t, switchboard, "10.11.1.2:1337")
+	node.JoinNetwork(context.Background(), &bootstrap.Self)
+
+	network := &Network{Node: node}
+	assert.Equal(t, DefaultRefreshInterval, network.RefreshInterval())
+	network.SetRefreshInterval(200 * time.Millisecond)
+
+	// The bucket of the bootstrap node is refreshed without anyone asking
+	index := node.Routes.getBucketIndex(bootstrap.Self.ID)
+	before := lastActivity(node.Routes, index)
+	assert.Eventually(t, func() bool {
+		return len(node.Routes.IdleBuckets(200*time.Millisecond)) == 0 &&
+			lastActivity(node.Routes, index).After(before.Add(150*time.Millisecond))
+	}, 2*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// RPCHandler answers a request and returns the payload of the response
+type RPCHandler func(network *Network, request RPC) (interface{}, error)
+
+// PayloadFormat converts a payload between its JSON form and the compact form
+// BinaryCodec puts on the wire
+type PayloadFormat struct {
+	Encode func(data json.RawMessage) ([]byte, error)
+	Decode func(payload []byte) (json.RawMessage, error)
+}
+
+// RPCKind describes one request/response pair of the protocol. Every kind is
+// registered once, and CreateResponseRPC, ExtractResponseData, Validate and
+// BinaryCodec all work from the registration.
+type RPCKind struct {
+	RequestType  string // e.g. "PingRequest"
+	ResponseType string // e.g. "PingResponse"
+	Handle       RPCHandler
+
+	// DecodeResponse parses the payload of a response into its Go type
+	DecodeResponse func(data json.RawMessage) (interface{}, error)
+
+	// Binary forms of the request and response payloads. Without them
+	// BinaryCodec carries the payload as JSON.
+	RequestFormat  *PayloadFormat
+	ResponseFormat *PayloadFormat
+}
+
+type rpcRegistry struct {
+	mu         sync.RWMutex
+	byRequest  map[string]RPCKind
+	byResponse map[string]RPCKind
+}
+
+var registry = &rpcRegistry{
+	byRequest:  make(map[string]RPCKind),
+	byResponse: make(map[string]RPCKind),
+}
+
+// RegisterRPC adds a kind of RPC every node in the process answers.
+// Applications embedding the node use it to add their own RPCs next to the
+// built-in ones; request and response types may only be registered once.
+func RegisterRPC(kind RPCKind) error {
+	if kind.RequestType == "" || kind.ResponseType == "" || kind.Handle == nil || kind.DecodeResponse == nil {
+		return errors.New("RPC kind needs request and response types, a handler and a decoder")
+	}
+	if isResponse(RPC{Type: kind.RequestType}) || !isResponse(RPC{Type: kind.ResponseType}) {
+		return errors.New("request types must not and response types must end in \"Response\"")
+	}
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	if _, found := registry.byRequest[kind.RequestType]; found {
+		return fmt.Errorf("RPC %s is already registered", kind.RequestType)
+	}
+	if _, found := registry.byResponse[kind.ResponseType]; found {
+		return fmt.Errorf("RPC %s is already registered", kind.ResponseType)
+	}
+
+	registry.byRequest[kind.RequestType] = kind
+	registry.byResponse[kind.ResponseType] = kind
+	return nil
+}
+
+func mustRegisterRPC(kind RPCKind) {
+	if err := RegisterRPC(kind); err != nil {
+		panic(err)
+	}
+}
+
+// unregisterRPC removes a kind again, so tests can register kinds of their
+// own without leaking them into the rest of the process
+func unregisterRPC(kind RPCKind) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	delete(registry.byRequest, kind.RequestType)
+	delete(registry.byResponse, kind.ResponseType)
+}
+
+func lookupRequest(requestType string) (RPCKind, bool) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	kind, found := registry.byRequest[requestType]
+	return kind, found
+}
+
+func lookupResponse(responseType string) (RPCKind, bool) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	kind, found := registry.byResponse[responseType]
+	return kind, found
+}
+
+// lookupFormat returns the binary form of the payload of an RPC type, if it
+// has one
+func lookupFormat(rpcType string) (*PayloadFormat, bool) {
+	if format, found := refusalFormats[rpcType]; found {
+		return format, true
+	}
+
+	if isResponse(RPC{Type: rpcType}) {
+		kind, found := lookupResponse(rpcType)
+		return kind.ResponseFormat, found && kind.ResponseFormat != nil
+	}
+	kind, found := lookupRequest(rpcType)
+	return kind.RequestFormat, found && kind.RequestFormat != nil
+}
+
+// SendRequest sends a request of any registered kind and returns the decoded
+// response payload
+func (network *Network) SendRequest(contact *Contact, requestType string, payload interface{}) (interface{}, error) {
+	if _, found := lookupRequest(requestType); !found {
+		return nil, fmt.Errorf("%w: %s is not registered", ErrEncode, requestType)
+	}
+
+	requestData, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrEncode, err)
+	}
+
+	requestRPC := RPC{
+		Type:   requestType,
+		Sender: network.Node.Self,
+		RpcID:  NewRandomKademliaID(),
+		Data:   json.RawMessage(requestData),
+	}
+
+	response, err := network.HandleResponseRPC(contact, requestRPC)
+	if err != nil {
+		return nil, err
+	}
+	if !Validate(requestRPC, response) {
+		return nil, fmt.Errorf("%w: %s does not answer %s", ErrBadResponse, response.Type, requestType)
+	}
+
+	return network.ExtractResponseData(response)
+}
@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type EchoRequest struct {
+	Text string
+}
+
+type EchoResponse struct {
+	Text string
+}
+
+var echoKind = RPCKind{
+	RequestType:  "EchoRequest",
+	ResponseType: "EchoResponse",
+	Handle: func(network *Network, request RPC) (interface{}, error) {
+		var echoReq EchoRequest
+		if err := json.Unmarshal(request.Data, &echoReq); err != nil {
+			return nil, badRequest(err)
+		}
+		return EchoResponse{Text: strings.ToUpper(echoReq.Text)}, nil
+	},
+	DecodeResponse: func(data json.RawMessage) (interface{}, error) {
+		var echoResponse EchoResponse
+		err := json.Unmarshal(data, &echoResponse)
+		return echoResponse, err
+	},
+	RequestFormat: binaryFormat(
+		func(w *binaryWriter, p EchoRequest) { w.string(p.Text) },
+		func(r *binaryReader) EchoRequest { return EchoRequest{Text: r.string()} },
+	),
+}
+
+// registerTestRPC registers a kind until the test is over, so running the
+// tests again in the same process can register it once more
+func registerTestRPC(t *testing.T, kind RPCKind) {
+	t.Helper()
+	assert.NoError(t, RegisterRPC(kind))
+	t.Cleanup(func() { unregisterRPC(kind) })
+}
+
+func TestRegisterCustomRPC(t *testing.T) {
+	registerTestRPC(t, echoKind)
+
+	// Types can only be registered once
+	assert.Error(t, RegisterRPC(echoKind))
+	assert.Error(t, RegisterRPC(RPCKind{RequestType: "PingRequest", ResponseType: "OtherResponse",
+		Handle: echoKind.Handle, DecodeResponse: echoKind.DecodeResponse}))
+
+	// Incomplete or misnamed kinds are refused
+	assert.Error(t, RegisterRPC(RPCKind{RequestType: "FooRequest", ResponseType: "FooResponse"}))
+	assert.Error(t, RegisterRPC(RPCKind{RequestType: "FooResponse", ResponseType: "FooRequest",
+		Handle: echoKind.Handle, DecodeResponse: echoKind.DecodeResponse}))
+
+	switchboard := NewSwitchboard()
+	first := startMemoryNode(t, switchboard, "10.0.0.1:1337")
+	second := startMemoryNode(t, switchboard, "10.0.0.2:1337")
+
+	response, err := (&Network{Node: first}).SendRequest(&second.Self, "EchoRequest", EchoRequest{Text: "hej"})
+	assert.NoError(t, err)
+	assert.Equal(t, EchoResponse{Text: "HEJ"}, response)
+
+	// The custom kind is validated like the built-in ones
+	requestID := NewRandomKademliaID()
+	assert.True(t, Validate(RPC{Type: "EchoRequest", RpcID: requestID}, RPC{Type: "EchoResponse", RpcID: requestID}))
+	assert.False(t, Validate(RPC{Type: "EchoRequest", RpcID: requestID}, RPC{Type: "PingResponse", RpcID: requestID}))
+
+	// Unregistered requests are not sent at all
+	_, err = (&Network{Node: first}).SendRequest(&second.Self, "UnknownRequest", nil)
+	assert.ErrorIs(t, err, ErrEncode)
+}
+
+func TestCustomRPCBinaryFormat(t *testing.T) {
+	registerTestRPC(t, echoKind)
+
+	// Payloads with a binary form are written in it, the others as JSON
+	request, _ := json.Marshal(EchoRequest{Text: "hej"})
+	response, _ := json.Marshal(EchoResponse{Text: "HEJ"})
+	for _, rpc := range []RPC{
+		{Type: "EchoRequest", RpcID: NewRandomKademliaID(), Data: request},
+		{Type: "EchoResponse", RpcID: NewRandomKademliaID(), Data: response},
+	} {
+		encoded, err := BinaryCodec{}.Encode(rpc)
+		assert.NoError(t, err)
+		assert.Equal(t, rpc.Type == "EchoResponse", bytes.Contains(encoded, []byte(`"Text"`)))
+
+		decoded, err := BinaryCodec{}.Decode(encoded)
+		assert.NoError(t, err)
+		assert.JSONEq(t, string(rpc.Data), string(decoded.Data))
+	}
+
+	// Once the kind is gone its binary payloads can not be read anymore
+	encoded, _ := BinaryCodec{}.Encode(RPC{Type: "EchoRequest", Data: request})
+	unregisterRPC(echoKind)
+	_, err := BinaryCodec{}.Decode(encoded)
+	assert.Error(t, err)
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrReplay is returned for requests that were seen before or were not sent
+// recently. Signatures prove who made a request, but not that they meant to
+// send it again; without this a captured StoreRequest could keep a value
+// alive forever.
+var ErrReplay = errors.New("replayed request")
+
+// How far the timestamp of a request may be from our clock. Requests are
+// remembered for this long after they were sent; older ones are refused for
+// their timestamp alone.
+const maxClockSkew = 30 * time.Second
+
+// Requests one sender may have in the window at once. A sender above it is
+// refused until its old requests expire, so the window never forgets a
+// request that could still be replayed.
+const maxSeenPerSender = 4096
+
+type replayKey struct {
+	rpcID     KademliaID
+	timestamp int64
+}
+
+// replayWindow remembers the requests of the last maxClockSkew by sender.
+// Resends of a request are stamped and signed again, so they have the same
+// RpcID but a new timestamp and are not mistaken for replays.
+type replayWindow struct {
+	mu        sync.Mutex
+	seen      map[KademliaID]map[replayKey]time.Time // Until when each request is remembered
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newReplayWindow() *replayWindow {
+	return &replayWindow{
+		seen:      make(map[KademliaID]map[replayKey]time.Time),
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// check accepts a request the first time it is seen within maxClockSkew of
+// being sent. The sender and timestamp have to be verified by the signature
+// before.
+func (window *replayWindow) check(request RPC) error {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+
+	now := window.now()
+	sent := time.Unix(0, request.Timestamp)
+	if sent.Before(now.Add(-maxClockSkew)) || sent.After(now.Add(maxClockSkew)) {
+		return fmt.Errorf("%w: sent at %v", ErrReplay, sent.Format(time.RFC3339Nano))
+	}
+	if request.Sender.ID == nil || request.RpcID == nil {
+		return fmt.Errorf("%w: no sender or RpcID", ErrReplay)
+	}
+
+	window.sweep(now)
+
+	seen, found := window.seen[*request.Sender.ID]
+	if !found {
+		seen = make(map[replayKey]time.Time)
+		window.seen[*request.Sender.ID] = seen
+	}
+	key := replayKey{rpcID: *request.RpcID, timestamp: request.Timestamp}
+	if _, found := seen[key]; found {
+		return fmt.Errorf("%w: %s %v was seen before", ErrReplay, request.Type, request.RpcID)
+	}
+	if len(seen) >= maxSeenPerSender {
+		forgetExpired(seen, now)
+		if len(seen) >= maxSeenPerSender {
+			return fmt.Errorf("%w: too many requests in the window", ErrReplay)
+		}
+	}
+
+	seen[key] = sent.Add(maxClockSkew)
+	return nil
+}
+
+// sweep forgets the requests whose timestamp is too old to pass anymore
+func (window *replayWindow) sweep(now time.Time) {
+	if now.Sub(window.lastSweep) < maxClockSkew {
+		return
+	}
+	window.lastSweep = now
+
+	for sender, seen := range window.seen {
+		forgetExpired(seen, now)
+		if len(seen) == 0 {
+			delete(window.seen, sender)
+		}
+	}
+}
+
+func forgetExpired(seen map[replayKey]time.Time, now time.Time) {
+	for key, until := range seen {
+		if now.After(until) {
+			delete(seen, key)
+		}
+	}
+}
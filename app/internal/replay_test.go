@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayWindow(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	window := newReplayWindow()
+	window.now = func() time.Time { return now }
+	window.lastSweep = now
+
+	sender := NewContact(NewRandomKademliaID(), "127.0.0.1:1337")
+	request := RPC{Type: "StoreRequest", Sender: sender, RpcID: NewRandomKademliaID(), Timestamp: now.UnixNano()}
+
+	// A request is accepted once
+	assert.NoError(t, window.check(request))
+	assert.ErrorIs(t, window.check(request), ErrReplay)
+
+	// A resend has the same RpcID but a new timestamp
+	resend := request
+	resend.Timestamp = now.Add(time.Second).UnixNano()
+	assert.NoError(t, window.check(resend))
+
+	// The same RpcID from someone else is a different request
+	other := request
+	other.Sender = NewContact(NewRandomKademliaID(), "127.0.0.1:1338")
+	assert.NoError(t, window.check(other))
+
+	// Requests from too far in the past or future are refused
+	stale := RPC{Type: "StoreRequest", Sender: sender, RpcID: NewRandomKademliaID(), Timestamp: now.Add(-time.Minute).UnixNano()}
+	assert.ErrorIs(t, window.check(stale), ErrReplay)
+	future := RPC{Type: "StoreRequest", Sender: sender, RpcID: NewRandomKademliaID(), Timestamp: now.Add(time.Minute).UnixNano()}
+	assert.ErrorIs(t, window.check(future), ErrReplay)
+	assert.ErrorIs(t, window.check(RPC{Type: "StoreRequest", Sender: sender, RpcID: NewRandomKademliaID()}), ErrReplay)
+
+	// Once the timestamp is too old to pass, the request is forgotten
+	now = now.Add(2 * maxClockSkew)
+	assert.ErrorIs(t, window.check(request), ErrReplay)
+	assert.NoError(t, window.check(RPC{Type: "PingRequest", Sender: sender, RpcID: NewRandomKademliaID(), Timestamp: now.UnixNano()}))
+	assert.Len(t, window.seen, 1)
+	assert.Len(t, window.seen[*sender.ID], 1)
+}
+
+func TestReplayedRequestIsDropped(t *testing.T) {
+	switchboard := NewSwitchboard()
+	node := startMemoryNode(t, switchboard, "10.8.0.1:1337")
+	nodeNetwork := &Network{Node: node}
+	transport, _ := switchboard.Listen("10.8.0.2:1337")
+	defer transport.Close()
+
+	sender := NewKademliaNode("10.8.0.2:1337")
+	ping := signedPing(t, &sender)
+	encoded, _ := BinaryCodec{}.Encode(ping)
+
+	buffer := make([]byte, maxDatagramSize)
+	assert.NoError(t, transport.Send(node.Self.Address, encoded))
+	_, _, err := transport.Receive(buffer)
+	assert.NoError(t, err)
+
+	// The captured request is not answered again
+	assert.NoError(t, transport.Send(node.Self.Address, encoded))
+	assert.Eventually(t, func() bool {
+		return nodeNetwork.Stats().Malformed == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// A resend signed again by the sender is
+	stamp(&ping)
+	assert.NoError(t, (&Network{Node: &sender}).sign(&ping))
+	encoded, _ = BinaryCodec{}.Encode(ping)
+	assert.NoError(t, transport.Send(node.Self.Address, encoded))
+	n, _, err := transport.Receive(buffer)
+	assert.NoError(t, err)
+	response, err := DeserializeRPC(buffer[:n])
+	assert.NoError(t, err)
+	assert.Equal(t, ping.RpcID, response.RpcID)
+	assert.Equal(t, uint64(1), nodeNetwork.Stats().Malformed)
+}
@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// RetryPolicy decides how long we wait for the response to one type of RPC
+// and how often the request is resent before the contact counts as failed.
+type RetryPolicy struct {
+	Timeout    time.Duration // Time to wait for a response from contacts without a measured round-trip time
+	MinTimeout time.Duration // Shortest time to wait for contacts with one, see ContactHealth.Timeout
+	Retries    int           // Number of resends after the first attempt
+	Backoff    time.Duration // Pause before the first resend, doubled for every following one
+	MaxBackoff time.Duration // Upper limit for the pause between resends
+}
+
+// DefaultRetryPolicy is used for every RPC type without its own policy
+var DefaultRetryPolicy = RetryPolicy{
+	Timeout:    500 * time.Millisecond,
+	MinTimeout: defaultMinTimeout,
+	Retries:    1,
+	Backoff:    100 * time.Millisecond,
+	MaxBackoff: 2 * time.Second,
+}
+
+// A contact is evicted from the routing table after this many requests in a
+// row went unanswered.
+const defaultMaxFailures = 3
+
+// backoff returns the pause before resend number attempt (starting at 1)
+func (policy RetryPolicy) backoff(attempt int) time.Duration {
+	pause := policy.Backoff
+	for i := 1; i < attempt; i++ {
+		pause *= 2
+		if policy.MaxBackoff > 0 && pause >= policy.MaxBackoff {
+			return policy.MaxBackoff
+		}
+	}
+	return pause
+}
+
+// retrySettings holds the retry policies and how many failures in a row
+// evict a contact. It is shared by all Network handles of a node.
+type retrySettings struct {
+	mu          sync.Mutex
+	policies    map[string]RetryPolicy
+	maxFailures int
+}
+
+func newRetrySettings() *retrySettings {
+	return &retrySettings{
+		policies:    make(map[string]RetryPolicy),
+		maxFailures: defaultMaxFailures,
+	}
+}
+
+// SetRetryPolicy sets the timeout, retries and backoff used for requests of
+// the given type, e.g. "FindContactRequest".
+func (network *Network) SetRetryPolicy(rpcType string, policy RetryPolicy) {
+	settings := network.Node.retry
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+
+	settings.policies[rpcType] = policy
+}
+
+// RetryPolicy returns the policy used for requests of the given type
+func (network *Network) RetryPolicy(rpcType string) RetryPolicy {
+	settings := network.Node.retry
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+
+	policy, found := settings.policies[rpcType]
+	if !found {
+		return DefaultRetryPolicy
+	}
+	return policy
+}
+
+// SetMaxFailures sets how many requests in a row a contact may leave
+// unanswered before it is removed from the routing table.
+func (network *Network) SetMaxFailures(maxFailures int) {
+	settings := network.Node.retry
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+
+	settings.maxFailures = maxFailures
+}
+
+// timeout returns how long to wait for the contact to answer attempt number
+// attempt (starting at 0). Contacts with a measured round-trip time get a
+// timeout of their own, which is doubled for every resend in case the
+// round-trip time has grown since (Karn's algorithm). Resends are not
+// measured, so the estimate alone would never catch up.
+func (network *Network) timeout(contact *Contact, policy RetryPolicy, attempt int) time.Duration {
+	health, found := network.Node.Routes.Health(contact.ID)
+	if !found || health.RTT == 0 {
+		return policy.Timeout
+	}
+
+	timeout := health.Timeout(policy)
+	for i := 0; i < attempt && timeout < maxTimeout; i++ {
+		timeout *= 2
+	}
+	if timeout > maxTimeout {
+		return maxTimeout
+	}
+	return timeout
+}
+
+// evicts reports whether a contact that failed this many requests in a row
+// is to be removed from the routing table
+func (settings *retrySettings) evicts(failures int) bool {
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+
+	return failures > 0 && failures >= settings.maxFailures
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{
+		Backoff:    100 * time.Millisecond,
+		MaxBackoff: 300 * time.Millisecond,
+	}
+
+	// The pause doubles for every resend until it reaches the limit
+	assert.Equal(t, 100*time.Millisecond, policy.backoff(1))
+	assert.Equal(t, 200*time.Millisecond, policy.backoff(2))
+	assert.Equal(t, 300*time.Millisecond, policy.backoff(3))
+	assert.Equal(t, 300*time.Millisecond, policy.backoff(10))
+}
+
+func TestRetryPolicyPerType(t *testing.T) {
+	node := NewKademliaNode("127.0.0.1:1400")
+	network := &Network{Node: &node}
+
+	// Types without their own policy fall back to the default
+	assert.Equal(t, DefaultRetryPolicy, network.RetryPolicy("PingRequest"))
+
+	storePolicy := RetryPolicy{Timeout: time.Second, Retries: 3}
+	network.SetRetryPolicy("StoreRequest", storePolicy)
+	assert.Equal(t, storePolicy, network.RetryPolicy("StoreRequest"))
+	assert.Equal(t, DefaultRetryPolicy, network.RetryPolicy("PingRequest"))
+}
+
+func TestFailuresBeforeEviction(t *testing.T) {
+	settings := newRetrySettings()
+	settings.maxFailures = 3
+
+	// The contact is only evicted after maxFailures failures in a row
+	assert.False(t, settings.evicts(0))
+	assert.False(t, settings.evicts(2))
+	assert.True(t, settings.evicts(3))
+	assert.True(t, settings.evicts(4))
+}
+
+func TestAdaptiveTimeout(t *testing.T) {
+	node := NewKademliaNode("127.0.0.1:1403")
+	network := &Network{Node: &node}
+	policy := RetryPolicy{Timeout: 500 * time.Millisecond}
+
+	// Unknown and unmeasured contacts wait as long as the policy says
+	contact := NewContact(NewRandomKademliaID(), "127.0.0.1:1404")
+	assert.Equal(t, policy.Timeout, network.timeout(&contact, policy, 0))
+	node.Routes.AddContact(contact)
+	assert.Equal(t, policy.Timeout, network.timeout(&contact, policy, 0))
+	assert.Equal(t, policy.Timeout, network.timeout(&Contact{Address: contact.Address}, policy, 0))
+
+	// A LAN contact gets the shortest timeout, doubled for every resend
+	node.Routes.recordResponse(contact.ID, time.Millisecond)
+	assert.Equal(t, defaultMinTimeout, network.timeout(&contact, policy, 0))
+	assert.Equal(t, 2*defaultMinTimeout, network.timeout(&contact, policy, 1))
+	assert.Equal(t, maxTimeout, network.timeout(&contact, policy, 20))
+
+	// A slow one is given longer than the policy's timeout
+	slow := NewContact(NewRandomKademliaID(), "127.0.0.1:1405")
+	node.Routes.AddContact(slow)
+	node.Routes.recordResponse(slow.ID, 800*time.Millisecond)
+	assert.Equal(t, 2400*time.Millisecond, network.timeout(&slow, policy, 0))
+}
+
+func TestSendPingMessageTimeout(t *testing.T) {
+	node := startMemoryNode(t, NewSwitchboard(), "10.14.2.1:1337")
+	network := &Network{Node: node}
+
+	network.SetRetryPolicy("PingRequest", RetryPolicy{
+		Timeout: 50 * time.Millisecond,
+		Retries: 2,
+		Backoff: 10 * time.Millisecond,
+	})
+	network.SetMaxFailures(2)
+
+	// Nobody listens on this address
+	deadContact := NewContact(NewRandomKademliaID(), "10.14.2.2:1337")
+	node.Routes.AddContact(deadContact)
+
+	_, err := network.SendPingMessage(&deadContact)
+	assert.ErrorIs(t, err, ErrTimeout)
+	assert.Len(t, node.Routes.FindClosestContacts(deadContact.ID, 1), 1, "One failure should not evict the contact")
+
+	_, err = network.SendPingMessage(&deadContact)
+	assert.Error(t, err)
+	assert.Len(t, node.Routes.FindClosestContacts(deadContact.ID, 1), 0, "Contact should be evicted after two failures")
+}
@@ -1,11 +1,20 @@
 package internal
 
+import (
+	"crypto/rand"
+	"sync"
+	"time"
+)
+
 const bucketSize = 20
 
 // RoutingTable definition
-// keeps a refrence contact of me and an array of buckets
+// keeps a refrence contact of me and an array of buckets. It is used by the
+// request handlers, lookups and background tasks at once; mu guards the
+// buckets, me never changes.
 type RoutingTable struct {
 	me      Contact
+	mu      sync.RWMutex
 	buckets [IDLength * 8]*bucket
 }
 
@@ -19,23 +28,49 @@ func NewRoutingTable(me Contact) *RoutingTable {
 	return routingTable
 }
 
-// AddContact add a new contact to the correct Bucket
-func (routingTable *RoutingTable) AddContact(contact Contact) {
+// AddContact add a new contact to the correct Bucket. If the bucket is full
+// the contact is kept as a replacement, and the least recently seen contact
+// of the bucket is returned to be pinged, see bucket.AddContact.
+func (routingTable *RoutingTable) AddContact(contact Contact) (leastRecent Contact, full bool) {
+	// We are not a contact of our own, lookups may still turn us up
+	if contact.ID.Equals(routingTable.me.ID) {
+		return Contact{}, false
+	}
+
 	bucketIndex := routingTable.getBucketIndex(contact.ID)
+	routingTable.mu.Lock()
+	defer routingTable.mu.Unlock()
+
 	bucket := routingTable.buckets[bucketIndex]
-	bucket.AddContact(contact)
+	return bucket.AddContact(contact)
 }
 
 func (routingTable *RoutingTable) RemoveContact(contact Contact) {
 	bucketIndex := routingTable.getBucketIndex(contact.ID)
+	routingTable.mu.Lock()
+	defer routingTable.mu.Unlock()
+
 	bucket := routingTable.buckets[bucketIndex]
 	bucket.RemoveContact(contact)
 }
 
+// Contains reports whether a contact with the ID is in the RoutingTable
+func (routingTable *RoutingTable) Contains(id *KademliaID) bool {
+	bucketIndex := routingTable.getBucketIndex(id)
+	routingTable.mu.RLock()
+	defer routingTable.mu.RUnlock()
+
+	bucket := routingTable.buckets[bucketIndex]
+	return bucket.Contains(id)
+}
+
 // FindClosestContacts finds the count closest Contacts to the target in the RoutingTable
 func (routingTable *RoutingTable) FindClosestContacts(target *KademliaID, count int) []Contact {
 	var candidates ContactCandidates
 	bucketIndex := routingTable.getBucketIndex(target)
+	routingTable.mu.RLock()
+	defer routingTable.mu.RUnlock()
+
 	bucket := routingTable.buckets[bucketIndex]
 
 	candidates.Append(bucket.GetContactAndCalcDistance(target))
@@ -60,6 +95,70 @@ func (routingTable *RoutingTable) FindClosestContacts(target *KademliaID, count
 	return candidates.GetContacts(count)
 }
 
+// Touch marks the bucket id falls into as active, for lookups of id
+func (routingTable *RoutingTable) Touch(id *KademliaID) {
+	bucketIndex := routingTable.getBucketIndex(id)
+	routingTable.mu.Lock()
+	defer routingTable.mu.Unlock()
+
+	routingTable.buckets[bucketIndex].lastActivity = time.Now()
+}
+
+// IdleBuckets returns the indexes of the buckets without activity for at
+// least idle. Buckets closer to us than the closest contact are left out;
+// there is nobody in their range to find.
+func (routingTable *RoutingTable) IdleBuckets(idle time.Duration) []int {
+	routingTable.mu.RLock()
+	defer routingTable.mu.RUnlock()
+
+	var indexes []int
+	now := time.Now()
+	for i := 0; i <= routingTable.closestBucket(); i++ {
+		if now.Sub(routingTable.buckets[i].lastActivity) >= idle {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// closestBucket returns the index of the closest bucket that has contacts,
+// or -1 if the RoutingTable is empty. The caller holds mu.
+func (routingTable *RoutingTable) closestBucket() int {
+	for i := IDLength*8 - 1; i >= 0; i-- {
+		if routingTable.buckets[i].Len() > 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// RandomIDInBucket returns a random ID that falls into the bucket with the
+// index: it shares the first index bits with our ID and differs in the next
+func (routingTable *RoutingTable) RandomIDInBucket(index int) *KademliaID {
+	var distance KademliaID
+	_, err := rand.Read(distance[:])
+	mustRandom(err)
+
+	// Clear the bits before the index and set the one at it
+	for i := 0; i < index/8; i++ {
+		distance[i] = 0
+	}
+	bit := uint8(7 - index%8)
+	distance[index/8] &= 1<<(bit+1) - 1
+	distance[index/8] |= 1 << bit
+
+	return routingTable.me.ID.CalcDistance(&distance)
+}
+
+// Replacements returns the replacement cache of the bucket id falls into
+func (routingTable *RoutingTable) Replacements(id *KademliaID) []Contact {
+	bucketIndex := routingTable.getBucketIndex(id)
+	routingTable.mu.RLock()
+	defer routingTable.mu.RUnlock()
+
+	return routingTable.buckets[bucketIndex].Replacements()
+}
+
 // getBucketIndex get the correct Bucket index for the KademliaID
 func (routingTable *RoutingTable) getBucketIndex(id *KademliaID) int {
 	distance := id.CalcDistance(routingTable.me.ID)
@@ -2,7 +2,10 @@ package internal
 
 import (
 	"fmt"
+	"sync"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestRoutingTable(t *testing.T) {
@@ -20,3 +23,29 @@ func TestRoutingTable(t *testing.T) {
 		fmt.Println(contacts[i].String())
 	}
 }
+
+func TestRoutingTableConcurrentUse(t *testing.T) {
+	rt := NewRoutingTable(NewContact(NewRandomKademliaID(), "localhost:8000"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				contact := NewContact(NewRandomKademliaID(), fmt.Sprintf("localhost:%d", 9000+i))
+				rt.AddContact(contact)
+				rt.FindClosestContacts(contact.ID, bucketSize)
+				rt.Contains(contact.ID)
+				rt.Touch(contact.ID)
+				rt.IdleBuckets(0)
+				if j%2 == 0 {
+					rt.RemoveContact(contact)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.NotEmpty(t, rt.FindClosestContacts(NewRandomKademliaID(), bucketSize))
+}
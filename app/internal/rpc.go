@@ -1,18 +1,36 @@
 package internal
 
 import (
+	"crypto/ed25519"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"log"
 	"time"
 )
 
 type RPC struct {
-	Type   string
-	Sender Contact
-	RpcID  *KademliaID
-	Data   json.RawMessage
+	Type         string
+	Sender       Contact
+	RpcID        *KademliaID
+	Data         json.RawMessage
+	Version      uint16     `json:",omitempty"` // Protocol version of the sender
+	Capabilities Capability `json:",omitempty"` // Optional features the sender supports
+	Timestamp    int64      `json:",omitempty"` // Unix time in nanoseconds the message was sent at
+
+	// The sender's public key, which its ID is derived from, and the
+	// signature over the rest of the message
+	PublicKey ed25519.PublicKey `json:",omitempty"`
+	Signature []byte            `json:",omitempty"`
+
+	// Solution of the sender's dynamic crypto puzzle, see PuzzleDifficulty
+	PuzzleNonce *KademliaID `json:",omitempty"`
+
+	// Data is sealed with the session of sender and receiver
+	Encrypted bool `json:",omitempty"`
+
+	// Proof that the sender knows the key of our private network, see
+	// SetSwarmKey
+	MAC []byte `json:",omitempty"`
 }
 
 type PingRequest struct {
@@ -29,11 +47,13 @@ type FindContactRequest struct {
 
 type FindContactResponse struct {
 	Contacts []Contact
+	Token    []byte `json:",omitempty"` // Lets the requester store on us, see storeTokens
 }
 
 type StoreRequest struct {
-	Key  string // Hashed key in the request
-	Data string
+	Key   string // Hashed key in the request
+	Data  string
+	Token []byte `json:",omitempty"` // From a FindContactResponse or FindDataResponse of the receiver
 }
 
 type StoreResponse struct {
@@ -47,6 +67,7 @@ type FindDataRequest struct {
 type FindDataResponse struct {
 	Nodes []Contact // Nodes that are close to the data
 	Data  []byte
+	Token []byte `json:",omitempty"` // Lets the requester store on us, see storeTokens
 }
 
 type RefreshRequest struct {
@@ -57,291 +78,409 @@ type RefreshResponse struct {
 	Node Contact // Node that refreshed its data
 }
 
+type NodeInfoRequest struct{}
+
+type NodeInfoResponse struct {
+	Version      uint16
+	Capabilities Capability
+	Uptime       time.Duration
+}
+
+// HandshakeRequest starts a session for encrypted RPCs. Key is the sender's
+// X25519 key exchange key; it is covered by the RPC signature.
+type HandshakeRequest struct {
+	Key []byte
+}
+
+type HandshakeResponse struct {
+	Key []byte
+}
+
+// UnsupportedResponse answers a request whose type or protocol version the
+// node does not understand
+type UnsupportedResponse struct {
+	RequestType string
+	Version     uint16 // Protocol version spoken by the responding node
+	Reason      string
+}
+
 func SerializeRPC(rpc RPC) ([]byte, error) {
-	data, err := json.Marshal(rpc)
+	data, err := JSONCodec{}.Encode(rpc)
 	if err != nil {
 		return nil, err
 	}
 	return data, nil
 }
 
+// DeserializeRPC decodes a message in either the JSON or the binary encoding
 func DeserializeRPC(data []byte) (RPC, error) {
-	var rpc RPC
-	if err := json.Unmarshal(data, &rpc); err != nil {
+	rpc, err := codecFor(data).Decode(data)
+	if err != nil {
 		return RPC{}, err
 	}
 
 	return rpc, nil
 }
 
-func (network *Network) CreateResponseRPC(request RPC) (RPC, error) {
-	var response RPC
-	switch request.Type {
-	case "PingRequest":
-		var pingReq PingRequest
-		if err := json.Unmarshal(request.Data, &pingReq); err != nil {
-			log.Printf("Error unmarshaling PingRequest: %v", err)
-			return RPC{}, err
-		}
-		MessageID := pingReq.PingID
-
-		pingResponse := PingResponse{
-			PongID: MessageID,
-		}
-
-		responseData, err := json.Marshal(pingResponse)
-		if err != nil {
-			log.Printf("Error marshaling PingResponse: %v", err)
-			return RPC{}, err
-		}
-
-		response = RPC{
-			Sender: network.Node.Self,
-			Type:   "PingResponse",
-			Data:   json.RawMessage(responseData),
-			RpcID:  request.RpcID,
-		}
-
-	case "FindContactRequest":
-		var findContactReq FindContactRequest
-		if err := json.Unmarshal(request.Data, &findContactReq); err != nil {
-			log.Printf("Error unmarshaling FindContactRequest: %v", err)
-			return RPC{}, err
-		}
-		target := findContactReq.Target
-		contacts := network.Node.Routes.FindClosestContacts(target, bucketSize)
-
-		findContactResponse := FindContactResponse{
-			Contacts: contacts,
-		}
-
-		responseData, err := json.Marshal(findContactResponse)
-		if err != nil {
-			log.Printf("Error marshaling FindContactResponse: %v", err)
-			return RPC{}, err
-		}
-
-		response = RPC{
-			Sender: network.Node.Self,
-			Type:   "FindContactResponse",
-			Data:   json.RawMessage(responseData),
-			RpcID:  request.RpcID,
-		}
-
-	case "StoreRequest":
-		var storeReq StoreRequest
-		if err := json.Unmarshal(request.Data, &storeReq); err != nil {
-			log.Printf("Error unmarshaling StoreRequest: %v", err)
-			return RPC{}, err
-		}
-
-		network.Node.Datastore.putData(storeReq.Key, []byte(storeReq.Data))
-
-		storeResponse := StoreResponse{
-			KeyLocation: storeReq.Key,
-		}
+func init() {
+	mustRegisterRPC(RPCKind{
+		RequestType:  "PingRequest",
+		ResponseType: "PingResponse",
+		Handle:       handlePing,
+		DecodeResponse: func(data json.RawMessage) (interface{}, error) {
+			var pingResponse PingResponse
+			err := json.Unmarshal(data, &pingResponse)
+			return pingResponse, err
+		},
+		RequestFormat:  pingRequestFormat,
+		ResponseFormat: pingResponseFormat,
+	})
+	mustRegisterRPC(RPCKind{
+		RequestType:  "FindContactRequest",
+		ResponseType: "FindContactResponse",
+		Handle:       handleFindContact,
+		DecodeResponse: func(data json.RawMessage) (interface{}, error) {
+			var findContactResponse FindContactResponse
+			err := json.Unmarshal(data, &findContactResponse)
+			return findContactResponse, err
+		},
+		RequestFormat:  findContactRequestFormat,
+		ResponseFormat: findContactResponseFormat,
+	})
+	mustRegisterRPC(RPCKind{
+		RequestType:  "StoreRequest",
+		ResponseType: "StoreResponse",
+		Handle:       handleStore,
+		DecodeResponse: func(data json.RawMessage) (interface{}, error) {
+			var storeResponse StoreResponse
+			err := json.Unmarshal(data, &storeResponse)
+			return storeResponse, err
+		},
+		RequestFormat:  storeRequestFormat,
+		ResponseFormat: storeResponseFormat,
+	})
+	mustRegisterRPC(RPCKind{
+		RequestType:  "FindDataRequest",
+		ResponseType: "FindDataResponse",
+		Handle:       handleFindData,
+		DecodeResponse: func(data json.RawMessage) (interface{}, error) {
+			var findDataResponse FindDataResponse
+			err := json.Unmarshal(data, &findDataResponse)
+			return findDataResponse, err
+		},
+		RequestFormat:  findDataRequestFormat,
+		ResponseFormat: findDataResponseFormat,
+	})
+	// U2.
+	mustRegisterRPC(RPCKind{
+		RequestType:  "RefreshRequest",
+		ResponseType: "RefreshResponse",
+		Handle:       handleRefresh,
+		DecodeResponse: func(data json.RawMessage) (interface{}, error) {
+			var refreshResponse RefreshResponse
+			err := json.Unmarshal(data, &refreshResponse)
+			return refreshResponse, err
+		},
+		RequestFormat:  refreshRequestFormat,
+		ResponseFormat: refreshResponseFormat,
+	})
+	mustRegisterRPC(RPCKind{
+		RequestType:  "NodeInfoRequest",
+		ResponseType: "NodeInfoResponse",
+		Handle:       handleNodeInfo,
+		DecodeResponse: func(data json.RawMessage) (interface{}, error) {
+			var nodeInfoResponse NodeInfoResponse
+			err := json.Unmarshal(data, &nodeInfoResponse)
+			return nodeInfoResponse, err
+		},
+		RequestFormat:  nodeInfoRequestFormat,
+		ResponseFormat: nodeInfoResponseFormat,
+	})
+	mustRegisterRPC(RPCKind{
+		RequestType:  "HandshakeRequest",
+		ResponseType: "HandshakeResponse",
+		Handle:       handleHandshake,
+		DecodeResponse: func(data json.RawMessage) (interface{}, error) {
+			var handshakeResponse HandshakeResponse
+			err := json.Unmarshal(data, &handshakeResponse)
+			return handshakeResponse, err
+		},
+		RequestFormat:  handshakeRequestFormat,
+		ResponseFormat: handshakeResponseFormat,
+	})
+}
 
-		responseData, err := json.Marshal(storeResponse)
-		if err != nil {
-			log.Printf("Error marshaling StoreResponse: %v", err)
-			return RPC{}, err
-		}
+func (network *Network) CreateResponseRPC(request RPC) (RPC, error) {
+	if !supportedVersion(request) {
+		reason := fmt.Sprintf("protocol version %d is not supported", effectiveVersion(request))
+		return network.createUnsupportedResponse(request, reason)
+	}
 
-		response = RPC{
-			Sender: network.Node.Self,
-			Type:   "StoreResponse",
-			Data:   json.RawMessage(responseData),
-			RpcID:  request.RpcID,
-		}
+	kind, found := lookupRequest(request.Type)
+	if !found {
+		log.Printf("Unknown RPC request: %s", request.Type)
+		return network.createUnsupportedResponse(request, "unknown RPC request type")
+	}
 
-	case "FindDataRequest":
-		var findDataReq FindDataRequest
-		if err := json.Unmarshal(request.Data, &findDataReq); err != nil {
-			log.Printf("Error unmarshaling FindDataRequest: %v", err)
-			return RPC{}, err
-		}
-		var data []byte
-		var foundHash bool
-		data, foundHash = network.Node.getDataFromStore(findDataReq.Hash)
+	responsePayload, err := kind.Handle(network, request)
+	if err != nil {
+		return RPC{}, err
+	}
 
-		if foundHash {
+	responseData, err := json.Marshal(responsePayload)
+	if err != nil {
+		log.Printf("Error marshaling %s: %v", kind.ResponseType, err)
+		return RPC{}, err
+	}
 
-			findDataResponse := FindDataResponse{
-				Data: data,
-			}
+	response := RPC{
+		Sender: network.Node.Self,
+		Type:   kind.ResponseType,
+		Data:   json.RawMessage(responseData),
+		RpcID:  request.RpcID,
+	}
+	return response, nil
+}
 
-			// U2. Refresh when the data is transmitted
-			err := network.Node.Refresh(findDataReq.Hash)
-			if err != nil {
-				log.Printf("Could not find refresh data: %v", err)
-				return RPC{}, err
-			}
+func handlePing(network *Network, request RPC) (interface{}, error) {
+	var pingReq PingRequest
+	if err := json.Unmarshal(request.Data, &pingReq); err != nil {
+		log.Printf("Error unmarshaling PingRequest: %v", err)
+		return nil, badRequest(err)
+	}
+	MessageID := pingReq.PingID
 
-			responseData, err := json.Marshal(findDataResponse)
-			if err != nil {
-				log.Printf("Error marshaling FindDataResponse: %v", err)
-				return RPC{}, err
-			}
+	pingResponse := PingResponse{
+		PongID: MessageID,
+	}
+	return pingResponse, nil
+}
 
-			response = RPC{
-				Sender: network.Node.Self,
-				Type:   "FindDataResponse",
-				Data:   json.RawMessage(responseData),
-				RpcID:  request.RpcID,
-			}
+func handleFindContact(network *Network, request RPC) (interface{}, error) {
+	var findContactReq FindContactRequest
+	if err := json.Unmarshal(request.Data, &findContactReq); err != nil {
+		log.Printf("Error unmarshaling FindContactRequest: %v", err)
+		return nil, badRequest(err)
+	}
+	target := findContactReq.Target
+	contacts := network.Node.Routes.FindClosestContacts(target, bucketSize)
 
-			return response, nil
-		}
+	findContactResponse := FindContactResponse{
+		Contacts: contacts,
+		Token:    network.Node.tokens.issue(request.Sender),
+	}
+	return findContactResponse, nil
+}
 
-		// If the hash was not found then we get the contacts closer to the hash and return in order to update
-		// shortlist
-		contacts := network.Node.Routes.FindClosestContacts(NewKademliaID(findDataReq.Hash), 20)
+func handleStore(network *Network, request RPC) (interface{}, error) {
+	var storeReq StoreRequest
+	if err := json.Unmarshal(request.Data, &storeReq); err != nil {
+		log.Printf("Error unmarshaling StoreRequest: %v", err)
+		return nil, badRequest(err)
+	}
+	if !network.Node.tokens.valid(request.Sender, storeReq.Token) {
+		return nil, errBadToken
+	}
+	if len(storeReq.Data) > network.Node.Datastore.MaxValueSize {
+		return nil, ErrValueTooLarge
+	}
 
-		findDataResponse := FindDataResponse{
-			Nodes: contacts,
-		}
+	network.Node.Datastore.putData(storeReq.Key, []byte(storeReq.Data))
 
-		responseData, err := json.Marshal(findDataResponse)
-		if err != nil {
-			log.Printf("Error marshaling FindDataResponse: %v", err)
-			return RPC{}, err
-		}
+	storeResponse := StoreResponse{
+		KeyLocation: storeReq.Key,
+	}
+	return storeResponse, nil
+}
 
-		response = RPC{
-			Sender: network.Node.Self,
-			Type:   "FindDataResponse",
-			Data:   json.RawMessage(responseData),
-			RpcID:  request.RpcID,
-		}
+func handleFindData(network *Network, request RPC) (interface{}, error) {
+	var findDataReq FindDataRequest
+	if err := json.Unmarshal(request.Data, &findDataReq); err != nil {
+		log.Printf("Error unmarshaling FindDataRequest: %v", err)
+		return nil, badRequest(err)
+	}
+	var data []byte
+	var foundHash bool
+	data, foundHash = network.Node.getDataFromStore(findDataReq.Hash)
 
-		// U2. Nodes that receive the refresh request will update their TTL of the requested data hash
-	case "RefreshRequest":
-		var refreshReq RefreshRequest
-		if err := json.Unmarshal(request.Data, &refreshReq); err != nil {
-			log.Printf("Error unmarshaling FindDataRequest: %v", err)
-			return RPC{}, err
-		}
-		err := network.Node.Refresh(refreshReq.Hash)
+	if foundHash {
+		// U2. Refresh when the data is transmitted
+		err := network.Node.Refresh(findDataReq.Hash)
 		if err != nil {
 			log.Printf("Could not find refresh data: %v", err)
-			return RPC{}, err
+			return nil, err
 		}
 
-		refreshResponse := RefreshResponse{
-			Node: network.Node.Self,
+		findDataResponse := FindDataResponse{
+			Data:  data,
+			Token: network.Node.tokens.issue(request.Sender),
 		}
+		return findDataResponse, nil
+	}
 
-		responseData, err := json.Marshal(refreshResponse)
-		if err != nil {
-			log.Printf("Error marshaling RefreshResponse: %v", err)
-			return RPC{}, err
-		}
+	// If the hash was not found then we get the contacts closer to the hash and return in order to update
+	// shortlist
+	contacts := network.Node.Routes.FindClosestContacts(NewKademliaID(findDataReq.Hash), 20)
 
-		response = RPC{
-			Sender: network.Node.Self,
-			Type:   "RefreshResponse",
-			Data:   json.RawMessage(responseData),
-			RpcID:  request.RpcID,
-		}
+	findDataResponse := FindDataResponse{
+		Nodes: contacts,
+		Token: network.Node.tokens.issue(request.Sender),
+	}
+	return findDataResponse, nil
+}
 
-	default:
-		log.Printf("Unknown RPC request: %s", request.Type)
-		return RPC{}, errors.New("unknown RPC request type")
+// U2. Nodes that receive the refresh request will update their TTL of the requested data hash
+func handleRefresh(network *Network, request RPC) (interface{}, error) {
+	var refreshReq RefreshRequest
+	if err := json.Unmarshal(request.Data, &refreshReq); err != nil {
+		log.Printf("Error unmarshaling RefreshRequest: %v", err)
+		return nil, badRequest(err)
 	}
-	return response, nil
+	err := network.Node.Refresh(refreshReq.Hash)
+	if err != nil {
+		log.Printf("Could not find refresh data: %v", err)
+		return nil, err
+	}
+
+	refreshResponse := RefreshResponse{
+		Node: network.Node.Self,
+	}
+	return refreshResponse, nil
 }
 
-func (network *Network) ExtractResponseData(responseRPC RPC) (interface{}, error) {
-	switch responseRPC.Type {
-	case "PingResponse":
-		var pingResponse PingResponse
-		if err := json.Unmarshal(responseRPC.Data, &pingResponse); err != nil {
-			return nil, err
-		}
-		return pingResponse, nil
+func handleNodeInfo(network *Network, request RPC) (interface{}, error) {
+	nodeInfoResponse := NodeInfoResponse{
+		Version:      ProtocolVersion,
+		Capabilities: localCapabilities,
+		Uptime:       time.Since(network.Node.started),
+	}
+	return nodeInfoResponse, nil
+}
 
-	case "FindContactResponse":
-		var findContactResponse FindContactResponse
-		if err := json.Unmarshal(responseRPC.Data, &findContactResponse); err != nil {
-			return nil, err
-		}
-		return findContactResponse, nil
+func (network *Network) createUnsupportedResponse(request RPC, reason string) (RPC, error) {
+	unsupportedResponse := UnsupportedResponse{
+		RequestType: request.Type,
+		Version:     ProtocolVersion,
+		Reason:      reason,
+	}
 
-	case "StoreResponse":
-		var storeResponse StoreResponse
-		if err := json.Unmarshal(responseRPC.Data, &storeResponse); err != nil {
-			return nil, err
-		}
-		return storeResponse, nil
+	responseData, err := json.Marshal(unsupportedResponse)
+	if err != nil {
+		log.Printf("Error marshaling UnsupportedResponse: %v", err)
+		return RPC{}, err
+	}
 
-	case "FindDataResponse":
-		var findDataResponse FindDataResponse
-		if err := json.Unmarshal(responseRPC.Data, &findDataResponse); err != nil {
-			return nil, err
-		}
-		return findDataResponse, nil
+	return RPC{
+		Sender: network.Node.Self,
+		Type:   "UnsupportedResponse",
+		Data:   json.RawMessage(responseData),
+		RpcID:  request.RpcID,
+	}, nil
+}
 
-		// U2.
-	case "RefreshResponse":
-		var refreshResponse RefreshResponse
-		if err := json.Unmarshal(responseRPC.Data, &refreshResponse); err != nil {
-			return nil, err
-		}
-		return refreshResponse, nil
+func (network *Network) ExtractResponseData(responseRPC RPC) (interface{}, error) {
+	if err := remoteError(responseRPC); err != nil {
+		return nil, err
+	}
 
-	default:
-		return nil, fmt.Errorf("unknown Response Data type: %s", responseRPC.Type)
+	kind, found := lookupResponse(responseRPC.Type)
+	if !found {
+		return nil, fmt.Errorf("%w: unknown Response Data type: %s", ErrBadResponse, responseRPC.Type)
 	}
-}
 
-func (network *Network) HandleResponseRPC(contact *Contact, request RPC) (RPC, error) {
-	marshaledRPC, err := json.Marshal(request)
+	responseData, err := kind.DecodeResponse(responseRPC.Data)
 	if err != nil {
-		return RPC{}, fmt.Errorf("error marshaling data: %v", err)
+		return nil, fmt.Errorf("%w: %v", ErrBadResponse, err)
 	}
+	return responseData, nil
+}
 
-	conn, err := network.sendRPC(contact, marshaledRPC)
-	if err != nil {
-		return RPC{}, fmt.Errorf("error sending UDP message: %v", err)
+func (network *Network) HandleResponseRPC(contact *Contact, request RPC) (RPC, error) {
+	if request.Type != "HandshakeRequest" && network.encryptsFor(contact) {
+		response, err := network.sendEncrypted(contact, request)
+		// A peer we had not heard from before may turn out not to support
+		// encryption, it gets the request in plaintext instead
+		if err != nil && !network.encryptsFor(contact) {
+			return network.exchange(contact, request)
+		}
+		return response, err
 	}
-	defer conn.Close()
+	return network.exchange(contact, request)
+}
 
-	// Use a channel to signal when data is received or when the timeout occurs
-	responseChan := make(chan RPC)
-	errorChan := make(chan error)
+// exchange sends a request as it is and waits for the response
+func (network *Network) exchange(contact *Contact, request RPC) (RPC, error) {
+	policy := network.RetryPolicy(request.Type)
+
+	// Register before sending so a fast response cannot arrive unclaimed.
+	// Resends reuse the RpcID, so whichever attempt is answered first wins.
+	responseChan := network.Node.endpoint.register(request.RpcID)
+	defer network.Node.endpoint.unregister(request.RpcID)
+
+	for attempt := 0; attempt <= policy.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(policy.backoff(attempt)):
+			case <-network.Node.life.ctx.Done():
+				return RPC{}, ErrNodeClosed
+			}
+		}
 
-	go func() {
-		buf := make([]byte, 5000)
-		n, _, err := conn.ReadFromUDP(buf)
+		// Every attempt is stamped and signed anew. The peer drops exact
+		// copies of a request it has seen, and the first attempt may well
+		// have arrived with only its response lost.
+		stamp(&request)
+		if err := network.sign(&request); err != nil {
+			return RPC{}, fmt.Errorf("%w: %v", ErrEncode, err)
+		}
+		marshaledRPC, err := network.codecFor(contact).Encode(request)
 		if err != nil {
-			errorChan <- fmt.Errorf("error reading data: %v", err)
-			return
+			return RPC{}, fmt.Errorf("%w: %v", ErrEncode, err)
 		}
 
-		// Parse the received data to determine the response type
-		parsedResponse, err := DeserializeRPC(buf[:n])
+		timeout := network.timeout(contact, policy, attempt)
+		sent := time.Now()
+		err = network.sendRPC(contact, marshaledRPC, timeout)
 		if err != nil {
-			errorChan <- fmt.Errorf("error parsing RPC response: %v", err)
-			return
+			return RPC{}, fmt.Errorf("%w: %v", ErrSendFailed, err)
 		}
 
-		if Validate(request, parsedResponse) {
-			network.Node.Routes.AddContact(parsedResponse.Sender)
-		}
+		// Wait for the listener to route the response to us, or time out
+		select {
+		case response := <-responseChan:
+			// A response to a resend may answer any of the attempts, so
+			// only the first one gives a round-trip time (Karn's algorithm)
+			var rtt time.Duration
+			if attempt == 0 {
+				rtt = time.Since(sent)
+			}
 
-		responseChan <- parsedResponse
-	}()
+			// The peer is alive but refused the request, which is no
+			// reason to touch its place in the routing table
+			err := remoteError(response)
+			if err == nil && Validate(request, response) {
+				network.addContact(response.Sender)
+			}
 
-	// Use a select statement to wait for data or timeout
-	select {
-	case response := <-responseChan:
-		return response, nil
-	case err := <-errorChan:
-		return RPC{}, err
-	case <-time.After(500 * time.Millisecond):
-		network.Node.mu.Lock()
+			// The signature says who answered. A contact we knew under
+			// another ID, like a bootstrap node whose ID we could only
+			// guess, would otherwise stay in the routing table for good:
+			// its address always answers.
+			if contact.ID != nil && response.Sender.ID != nil && !contact.ID.Equals(response.Sender.ID) {
+				log.Printf("%v answered as %v, not %v", contact.Address, response.Sender.ID, contact.ID)
+				network.Node.Routes.RemoveContact(*contact)
+			}
+			network.Node.Routes.recordResponse(response.Sender.ID, rtt)
+			return response, err
+		case <-time.After(timeout):
+		case <-network.Node.life.ctx.Done():
+			return RPC{}, ErrNodeClosed
+		}
+	}
+
+	// A single lost packet should not throw a good peer out of the routing table
+	if network.Node.retry.evicts(network.Node.Routes.recordFailure(contact.ID)) {
 		network.Node.Routes.RemoveContact(*contact)
-		network.Node.mu.Unlock()
-		return RPC{}, fmt.Errorf("timeout while waiting for UDP response")
 	}
+	return RPC{}, fmt.Errorf("%w from %s", ErrTimeout, contact.Address)
 }
@@ -1,29 +1,208 @@
 package internal
 
 import (
-	"github.com/arek-e/D7024E/app/utils"
+	"context"
+	"encoding/json"
 	"testing"
+	"time"
+
+	"github.com/arek-e/D7024E/app/utils"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestCreateResponseRPCForUnknownRequest(t *testing.T) {
 	// Create a Network instance for testing
-	network := &Network{}
+	node := NewKademliaNode("127.0.0.1:1312")
+	network := &Network{Node: &node}
 
 	// Create a request with an unknown type
 	request := RPC{
-		Type: "UnknownRequestType",
+		Type:  "UnknownRequestType",
+		RpcID: NewRandomKademliaID(),
 	}
 
 	// Call the CreateResponseRPC function
 	response, err := network.CreateResponseRPC(request)
 
-	// Assert that an error is returned
-	assert.Error(t, err, "Expected an error for unknown request type")
+	// Assert that the request is refused with an unsupported reply
+	assert.NoError(t, err)
+	assert.Equal(t, "UnsupportedResponse", response.Type)
+	assert.Equal(t, request.RpcID, response.RpcID)
+	assert.True(t, Validate(request, response))
+
+	// The caller sees the refusal as an error
+	_, err = network.ExtractResponseData(response)
+	assert.ErrorContains(t, err, "UnknownRequestType not supported")
+}
+
+func TestCreateResponseRPCForUnsupportedVersion(t *testing.T) {
+	node := NewKademliaNode("127.0.0.1:1313")
+	network := &Network{Node: &node}
+
+	pingData, _ := json.Marshal(PingRequest{PingID: NewRandomKademliaID()})
+	request := RPC{
+		Type:    "PingRequest",
+		RpcID:   NewRandomKademliaID(),
+		Data:    pingData,
+		Version: ProtocolVersion + 1,
+	}
+
+	response, err := network.CreateResponseRPC(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "UnsupportedResponse", response.Type)
+
+	// Nodes that predate signed messages are refused as well
+	request.Version = 0
+	response, err = network.CreateResponseRPC(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "UnsupportedResponse", response.Type)
+
+	request.Version = ProtocolVersion
+	response, err = network.CreateResponseRPC(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "PingResponse", response.Type)
+}
+
+func TestServeAnswersUnsupportedVersion(t *testing.T) {
+	switchboard := NewSwitchboard()
+	node := startMemoryNode(t, switchboard, "10.13.1.1:1337")
+	nodeNetwork := &Network{Node: node}
+	oldNode, _ := switchboard.Listen("10.13.1.2:1337")
+	defer oldNode.Close()
+
+	// A node from before signed messages sends an unsigned request
+	pingData, _ := json.Marshal(PingRequest{PingID: NewRandomKademliaID()})
+	request := RPC{
+		Type:    "PingRequest",
+		Sender:  NewContact(NewRandomKademliaID(), oldNode.LocalAddr()),
+		RpcID:   NewRandomKademliaID(),
+		Data:    pingData,
+		Version: 2,
+	}
+	encoded, _ := JSONCodec{}.Encode(request)
+
+	buffer := make([]byte, maxDatagramSize)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, oldNode.Send(node.Self.Address, encoded))
+		n, _, err := oldNode.Receive(buffer)
+		assert.NoError(t, err)
+
+		response, err := JSONCodec{}.Decode(buffer[:n])
+		assert.NoError(t, err)
+		assert.Equal(t, "UnsupportedResponse", response.Type)
+		assert.Equal(t, request.RpcID, response.RpcID)
+	}
+
+	// Speaking an older version is not held against the sender, and it is
+	// not trusted into the routing table either
+	assert.Equal(t, uint64(0), nodeNetwork.Stats().Malformed)
+	assert.False(t, node.Routes.Contains(request.Sender.ID))
+}
+
+func TestRefusalFromNewerVersion(t *testing.T) {
+	switchboard := NewSwitchboard()
+	node := startMemoryNode(t, switchboard, "10.13.5.1:1337")
+	newer := NewKademliaNode("10.13.5.2:1337")
+	newerNode, _ := switchboard.Listen(newer.Self.Address)
+	defer newerNode.Close()
+	node.Routes.AddContact(newer.Self)
+
+	// A node one version ahead refuses every request we send it
+	go func() {
+		buffer := make([]byte, maxDatagramSize)
+		for {
+			n, from, err := newerNode.Receive(buffer)
+			if err != nil {
+				return
+			}
+			request, err := JSONCodec{}.Decode(buffer[:n])
+			if err != nil {
+				continue
+			}
+			response, _ := (&Network{Node: &newer}).createUnsupportedResponse(request, "version too old")
+			stamp(&response)
+			response.Version = ProtocolVersion + 1
+			encoded, _ := JSONCodec{}.Encode(response)
+			newerNode.Send(from, encoded)
+		}
+	}()
+
+	_, err := (&Network{Node: node}).SendPingMessage(&newer.Self)
+	var remoteErr *RemoteError
+	if assert.ErrorAs(t, err, &remoteErr) {
+		assert.Equal(t, CodeUnsupported, remoteErr.Code)
+	}
+
+	// The peer answered, so it is not counted as failing
+	health, found := node.Routes.Health(newer.Self.ID)
+	assert.True(t, found)
+	assert.Equal(t, 0, health.Failures)
+}
+
+func TestContactWithWrongIDIsReplaced(t *testing.T) {
+	switchboard := NewSwitchboard()
+	node := startMemoryNode(t, switchboard, "10.13.2.1:1337")
+	peer := startMemoryNode(t, switchboard, "10.13.2.2:1337")
+
+	// Like a bootstrap node, the peer's address is known but its ID is not
+	guessed := NewContact(NewRandomKademliaID(), peer.Self.Address)
+	node.Routes.AddContact(guessed)
+
+	_, err := (&Network{Node: node}).SendPingMessage(&guessed)
+	assert.NoError(t, err)
+
+	assert.False(t, node.Routes.Contains(guessed.ID), "The guessed ID should be removed")
+	assert.True(t, node.Routes.Contains(peer.Self.ID))
+	health, _ := node.Routes.Health(peer.Self.ID)
+	assert.Positive(t, health.RTT, "The answer counts for the real ID")
+}
+
+func TestSendNodeInfoMessage(t *testing.T) {
+	switchboard := NewSwitchboard()
+	first := startMemoryNode(t, switchboard, "10.0.0.1:1337")
+	second := startMemoryNode(t, switchboard, "10.0.0.2:1337")
 
-	// Assert that the response is empty
-	assert.Equal(t, RPC{}, response, "Expected an empty response for unknown request type")
+	info, err := (&Network{Node: first}).SendNodeInfoMessage(&second.Self)
+	assert.NoError(t, err)
+	assert.Equal(t, ProtocolVersion, info.Version)
+	assert.True(t, info.Capabilities.Has(CapNodeInfo|CapBinaryCodec))
+	assert.Greater(t, info.Uptime, time.Duration(0))
+}
+
+func TestErrorResponse(t *testing.T) {
+	switchboard := NewSwitchboard()
+	first := startMemoryNode(t, switchboard, "10.0.0.1:1337")
+	second := startMemoryNode(t, switchboard, "10.0.0.2:1337")
+	network := &Network{Node: first}
+	first.Routes.AddContact(second.Self)
+
+	// Refreshing a key the peer does not have fails on the peer's side
+	_, err := network.SendRefreshMessage(&second.Self, utils.Hash("Finns inte"))
+
+	var remoteErr *RemoteError
+	assert.ErrorIs(t, err, ErrRemote)
+	assert.ErrorAs(t, err, &remoteErr)
+	assert.Equal(t, CodeNotFound, remoteErr.Code)
+
+	// The peer answered, so it stays in the routing table
+	assert.Len(t, first.Routes.FindClosestContacts(second.Self.ID, 1), 1)
+
+	// Malformed payloads are refused as bad requests
+	response, err := (&Network{Node: second}).CreateResponseRPC(RPC{Type: "StoreRequest", Version: ProtocolVersion, Data: []byte("{")})
+	assert.Equal(t, RPC{}, response)
+	assert.Equal(t, CodeBadRequest, errorCode(err))
+
+	errorRPC, err := network.createErrorResponse(RPC{RpcID: NewRandomKademliaID()}, ErrValueTooLarge)
+	assert.NoError(t, err)
+	_, err = network.ExtractResponseData(errorRPC)
+	assert.ErrorAs(t, err, &remoteErr)
+	assert.Equal(t, CodeValueTooLarge, remoteErr.Code)
+
+	// Garbage from the peer is reported as a bad response
+	_, err = network.ExtractResponseData(RPC{Type: "PingResponse", Data: []byte("[")})
+	assert.ErrorIs(t, err, ErrBadResponse)
+	assert.NotErrorIs(t, err, ErrRemote)
 }
 
 func TestRetrieveNonExistentData(t *testing.T) {
@@ -39,23 +218,26 @@ func TestRetrieveNonExistentData(t *testing.T) {
 	bootNetwork := &Network{}
 	bootNetwork.Node = &bootstrapNode
 
-	go bootNetwork.Listen("127.0.0.1", 1310)
+	go bootNetwork.Listen(context.Background(), "127.0.0.1", 1310)
 
 	joinNetwork := &Network{}
-	joinNetwork.Node = &bootstrapNode
+	joinNetwork.Node = &secondNode
+
+	// The second node sends its requests from its listening socket
+	go joinNetwork.Listen(context.Background(), "127.0.0.1", 1311)
 
 	// Perform the join operation and get the contacts
-	_ = secondNode.JoinNetwork(&bootstrapNode.Self)
-	go joinNetwork.Listen("127.0.0.1", 1311)
+	_ = secondNode.JoinNetwork(context.Background(), &bootstrapNode.Self)
 
 	dataToStore := "Lagrar saker för testning"
-	hash := secondNode.Store([]byte(dataToStore))
+	hash, err := secondNode.Store(context.Background(), []byte(dataToStore))
+	assert.NoError(t, err)
 	assert.NotEmpty(t, hash)
 
 	lookupHash := utils.Hash("Hash som inte finns")
 
 	// Simulate retrieving the stored data
-	_, retrievedData, _ := secondNode.Lookup(lookupHash)
+	_, retrievedData, _ := secondNode.Lookup(context.Background(), lookupHash)
 
 	// Assert that the retrieved data matches the stored data
 	assert.Nil(t, retrievedData)
@@ -76,17 +258,17 @@ func TestHandleResponseRPCWithTimeout(t *testing.T) {
 	//bootstrapNetwork.Node = &bootstrapNode
 	//
 	//// Start listening on the bootstrap node's address
-	//go bootstrapNetwork.Listen("127.0.0.1", 1300)
+	//go bootstrapNetwork.Listen(context.Background(), "127.0.0.1", 1300)
 	//
 	//// Create a simulated network for the second node
 	//secondNetwork := &Network{}
 	//secondNetwork.Node = &secondNode
 	//
 	//// Start listening on the second node's address
-	//go secondNetwork.Listen("127.0.0.1", 1301)
+	//go secondNetwork.Listen(context.Background(), "127.0.0.1", 1301)
 	//
 	//// Perform the join operation for the second node
-	//_ = secondNode.JoinNetwork(&bootstrapNode.Self)
+	//_ = secondNode.JoinNetwork(context.Background(), &bootstrapNode.Self)
 	//
 	//// Create a contact for an address that is not in the network
 	//nonExistentNodeAddress := "127.0.0.1:1201" // This address is not part of the network
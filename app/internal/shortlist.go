@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"context"
 	"sort"
 )
 
@@ -55,11 +56,21 @@ func (shortlist *ShortList) refresh(contacts []Contact, notConsidered []ShortLis
 	}
 }
 
-func (shortlist *ShortList) updateShortList(targetID KademliaID, ch chan []Contact, conCh chan Contact, net Network) {
+func (shortlist *ShortList) updateShortList(ctx context.Context, targetID KademliaID, ch chan []Contact, conCh chan Contact, net Network) {
 	consideredList := ShortList{}
 	for {
-		contacts := <-ch
-		responder := <-conCh
+		var contacts []Contact
+		var responder Contact
+		select {
+		case contacts = <-ch:
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case responder = <-conCh:
+		case <-ctx.Done():
+			return
+		}
 		if len(contacts) > 0 {
 			shortlist.refresh(contacts, consideredList.Nodes)
 		} else {
@@ -73,16 +84,31 @@ func (shortlist *ShortList) updateShortList(targetID KademliaID, ch chan []Conta
 		if Done {
 			return
 		} else {
-			go PerformLookup(targetID, nextContact, net, ch, conCh)
+			go PerformLookup(ctx, targetID, nextContact, net, ch, conCh)
 		}
 	}
 }
 
-func (shortlist *ShortList) updateLookupData(hash string, ch chan []Contact, target chan []byte, dataContactCh chan Contact, net Network) ([]byte, Contact) {
+func (shortlist *ShortList) updateLookupData(ctx context.Context, hash string, ch chan []Contact, target chan []byte, dataContactCh chan Contact, net Network, errs *lookupErrors) ([]byte, Contact) {
 	for {
-		contacts := <-ch
-		targetData := <-target
-		dataContact := <-dataContactCh
+		var contacts []Contact
+		var targetData []byte
+		var dataContact Contact
+		select {
+		case contacts = <-ch:
+		case <-ctx.Done():
+			return nil, Contact{}
+		}
+		select {
+		case targetData = <-target:
+		case <-ctx.Done():
+			return nil, Contact{}
+		}
+		select {
+		case dataContact = <-dataContactCh:
+		case <-ctx.Done():
+			return nil, Contact{}
+		}
 
 		// data not nil = correct data is found
 		if targetData != nil {
@@ -94,7 +120,7 @@ func (shortlist *ShortList) updateLookupData(hash string, ch chan []Contact, tar
 		if Done {
 			return nil, Contact{}
 		} else {
-			go PerformLookupData(hash, nextContact, net, ch, target, dataContactCh)
+			go PerformLookupData(ctx, hash, nextContact, net, ch, target, dataContactCh, errs)
 		}
 	}
 }
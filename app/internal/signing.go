@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+)
+
+// ErrBadSignature is returned for messages that were not signed by the
+// node they claim to come from
+var ErrBadSignature = errors.New("invalid signature")
+
+// sign attaches the node's public key and signs the message. It has to be
+// the last change made to the RPC before it is encoded.
+func (network *Network) sign(rpc *RPC) error {
+	identity := network.Node.Identity
+	rpc.PublicKey = identity.PublicKey
+	rpc.PuzzleNonce = identity.Nonce
+
+	message, err := signedBytes(*rpc)
+	if err != nil {
+		return err
+	}
+	rpc.Signature = ed25519.Sign(identity.PrivateKey, message)
+	return network.Node.swarm.authenticate(rpc)
+}
+
+// verify checks that the sender ID was derived from the public key in the
+// message and that the key signed it. Messages failing this are dropped
+// before anything in them is trusted.
+func verify(rpc RPC) error {
+	if len(rpc.PublicKey) != ed25519.PublicKeySize || len(rpc.Signature) != ed25519.SignatureSize {
+		return fmt.Errorf("%w: message is not signed", ErrBadSignature)
+	}
+	if rpc.Sender.ID == nil || !rpc.Sender.ID.Equals(idForKey(rpc.PublicKey)) {
+		return fmt.Errorf("%w: sender ID does not belong to the public key", ErrBadSignature)
+	}
+
+	message, err := signedBytes(rpc)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+	if !ed25519.Verify(rpc.PublicKey, message, rpc.Signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// signedBytes returns what the signature of a message covers: its binary
+// encoding without the signature. The binary form is used whatever codec
+// the message travels in, since it is the same for the sender and receiver
+// no matter how the JSON payload was formatted.
+func signedBytes(rpc RPC) ([]byte, error) {
+	rpc.Signature = nil
+	rpc.MAC = nil
+	return BinaryCodec{}.Encode(rpc)
+}
@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func signedPing(t *testing.T, node *Kademlia) RPC {
+	pingData, _ := json.Marshal(PingRequest{PingID: NewRandomKademliaID()})
+	rpc := RPC{Type: "PingRequest", Sender: node.Self, RpcID: NewRandomKademliaID(), Data: pingData}
+	stamp(&rpc)
+	assert.NoError(t, (&Network{Node: node}).sign(&rpc))
+	return rpc
+}
+
+func TestSignAndVerify(t *testing.T) {
+	node := NewKademliaNode("127.0.0.1:1337")
+	other := NewKademliaNode("127.0.0.1:1338")
+
+	// The signature holds in both encodings
+	for _, codec := range []Codec{JSONCodec{}, BinaryCodec{}} {
+		encoded, err := codec.Encode(signedPing(t, &node))
+		assert.NoError(t, err)
+		decoded, err := codec.Decode(encoded)
+		assert.NoError(t, err)
+		assert.NoError(t, verify(decoded))
+	}
+
+	unsigned := signedPing(t, &node)
+	unsigned.PublicKey, unsigned.Signature = nil, nil
+	assert.ErrorIs(t, verify(unsigned), ErrBadSignature)
+
+	// Changing anything after signing breaks the signature
+	tampered := signedPing(t, &node)
+	tampered.Sender.Address = "127.0.0.1:9999"
+	assert.ErrorIs(t, verify(tampered), ErrBadSignature)
+
+	// Signing with one's own key does not make another node's ID usable
+	impostor := signedPing(t, &other)
+	impostor.Sender = node.Self
+	assert.NoError(t, (&Network{Node: &other}).sign(&impostor))
+	assert.ErrorIs(t, verify(impostor), ErrBadSignature)
+}
+
+func TestForgedMessageIsDropped(t *testing.T) {
+	switchboard := NewSwitchboard()
+	node := startMemoryNode(t, switchboard, "10.2.0.1:1337")
+	attacker, _ := switchboard.Listen("10.2.0.2:1337")
+	defer attacker.Close()
+
+	// The attacker claims an ID it holds no key for
+	victim := NewKademliaNode("10.2.0.3:1337")
+	forged := signedPing(t, &victim)
+	forged.Sender.Address = attacker.LocalAddr()
+	encoded, _ := JSONCodec{}.Encode(forged)
+	assert.NoError(t, attacker.Send(node.Self.Address, encoded))
+
+	// A message signed by the attacker's own key is answered
+	honest := NewKademliaNode(attacker.LocalAddr())
+	encoded, _ = JSONCodec{}.Encode(signedPing(t, &honest))
+	assert.NoError(t, attacker.Send(node.Self.Address, encoded))
+
+	buffer := make([]byte, maxDatagramSize)
+	n, _, err := attacker.Receive(buffer)
+	assert.NoError(t, err)
+	response, err := DeserializeRPC(buffer[:n])
+	assert.NoError(t, err)
+	assert.Equal(t, "PingResponse", response.Type)
+	assert.NoError(t, verify(response))
+
+	// Only the honest sender made it into the routing table
+	assert.Eventually(t, func() bool {
+		return len(node.Routes.FindClosestContacts(honest.Self.ID, 1)) == 1
+	}, time.Second, 10*time.Millisecond)
+	closest := node.Routes.FindClosestContacts(victim.Self.ID, 2)
+	assert.Len(t, closest, 1)
+	assert.Equal(t, honest.Self.ID, closest[0].ID)
+}
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// ErrBadMAC is returned for messages that were not sent with our swarm key
+var ErrBadMAC = errors.New("message is not from this private network")
+
+// swarmSettings holds the pre-shared key of a private network. Every RPC is
+// sent with a MAC made with the key, and messages without a valid one are
+// dropped, so nodes of different networks never learn about each other even
+// if they are told each other's address.
+type swarmSettings struct {
+	mu  sync.Mutex
+	key []byte
+}
+
+// SetSwarmKey makes the node part of the private network of everyone with
+// the same key. A nil key makes the network public again.
+func (network *Network) SetSwarmKey(key []byte) {
+	settings := network.Node.swarm
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+
+	settings.key = append([]byte(nil), key...)
+	if len(key) == 0 {
+		settings.key = nil
+	}
+}
+
+// SwarmKey returns the key of the private network the node is part of, or
+// nil if the network is public
+func (network *Network) SwarmKey() []byte {
+	settings := network.Node.swarm
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+
+	return settings.key
+}
+
+// authenticate attaches the MAC of the private network, if there is one.
+// It goes over the signature too, so it has to come after sign.
+func (settings *swarmSettings) authenticate(rpc *RPC) error {
+	key := settings.current()
+	rpc.MAC = nil
+	if key == nil {
+		return nil
+	}
+
+	mac, err := swarmMAC(key, *rpc)
+	if err != nil {
+		return err
+	}
+	rpc.MAC = mac
+	return nil
+}
+
+// check verifies the MAC of an incoming message. Everything is accepted
+// while the network is public.
+func (settings *swarmSettings) check(rpc RPC) error {
+	key := settings.current()
+	if key == nil {
+		return nil
+	}
+	if len(rpc.MAC) == 0 {
+		return ErrBadMAC
+	}
+
+	expected, err := swarmMAC(key, rpc)
+	if err != nil || !hmac.Equal(expected, rpc.MAC) {
+		return ErrBadMAC
+	}
+	return nil
+}
+
+func (settings *swarmSettings) current() []byte {
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+
+	return settings.key
+}
+
+// swarmMAC is the HMAC-SHA256 of the binary encoding of the message without
+// its MAC, for the same reason signatures are made over it
+func swarmMAC(key []byte, rpc RPC) ([]byte, error) {
+	rpc.MAC = nil
+	message, err := BinaryCodec{}.Encode(rpc)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("kademlia swarm"))
+	mac.Write(message)
+	return mac.Sum(nil), nil
+}
+
+// ReadSwarmKey reads the key of a private network from a file. Whitespace
+// around the key is left out, so the file can end with a newline.
+func ReadSwarmKey(path string) ([]byte, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := bytes.TrimSpace(contents)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("swarm key file %s is empty", path)
+	}
+	return key, nil
+}
@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startSwarmNode(t *testing.T, switchboard *Switchboard, address string, key []byte) (*Kademlia, *Network) {
+	node := startMemoryNode(t, switchboard, address)
+	network := &Network{Node: node}
+	network.SetSwarmKey(key)
+	network.SetRetryPolicy("PingRequest", RetryPolicy{Timeout: 100 * time.Millisecond})
+	return node, network
+}
+
+func TestSwarmKeySeparatesNetworks(t *testing.T) {
+	switchboard := NewSwitchboard()
+	first, firstNetwork := startSwarmNode(t, switchboard, "10.7.0.1:1337", []byte("first swarm"))
+	second, _ := startSwarmNode(t, switchboard, "10.7.0.2:1337", []byte("first swarm"))
+	other, otherNetwork := startSwarmNode(t, switchboard, "10.7.0.3:1337", []byte("other swarm"))
+	public, publicNetwork := startSwarmNode(t, switchboard, "10.7.0.4:1337", nil)
+
+	// Nodes with the same key talk to each other
+	_, err := firstNetwork.SendPingMessage(&second.Self)
+	assert.NoError(t, err)
+	assert.True(t, second.Routes.Contains(first.Self.ID))
+
+	// Everyone else is ignored, in both directions
+	_, err = otherNetwork.SendPingMessage(&first.Self)
+	assert.ErrorIs(t, err, ErrTimeout)
+	_, err = publicNetwork.SendPingMessage(&first.Self)
+	assert.ErrorIs(t, err, ErrTimeout)
+	_, err = firstNetwork.SendPingMessage(&public.Self)
+	assert.ErrorIs(t, err, ErrTimeout)
+	assert.False(t, first.Routes.Contains(other.Self.ID))
+	assert.False(t, first.Routes.Contains(public.Self.ID))
+
+	// Foreign traffic is not held against the source
+	assert.Empty(t, firstNetwork.Banned())
+	assert.Zero(t, firstNetwork.Stats().Malformed)
+}
+
+func TestSwarmMAC(t *testing.T) {
+	node := NewKademliaNode("127.0.0.1:1337")
+	network := &Network{Node: &node}
+	network.SetSwarmKey([]byte("swarm"))
+
+	pingData, _ := json.Marshal(PingRequest{PingID: NewRandomKademliaID()})
+	rpc := RPC{Type: "PingRequest", Sender: node.Self, RpcID: NewRandomKademliaID(), Data: pingData}
+	stamp(&rpc)
+	assert.NoError(t, network.sign(&rpc))
+	assert.NotEmpty(t, rpc.MAC)
+
+	// The MAC survives both codecs and does not break the signature
+	for _, codec := range []Codec{JSONCodec{}, BinaryCodec{}} {
+		encoded, err := codec.Encode(rpc)
+		assert.NoError(t, err)
+		decoded, err := codec.Decode(encoded)
+		assert.NoError(t, err)
+		assert.NoError(t, node.swarm.check(decoded))
+		assert.NoError(t, verify(decoded))
+	}
+
+	// Any change to the message or the MAC is caught
+	tampered := rpc
+	tampered.Type = "FindContactRequest"
+	assert.ErrorIs(t, node.swarm.check(tampered), ErrBadMAC)
+	tampered = rpc
+	tampered.MAC = append([]byte(nil), rpc.MAC...)
+	tampered.MAC[0] ^= 1
+	assert.ErrorIs(t, node.swarm.check(tampered), ErrBadMAC)
+	tampered.MAC = nil
+	assert.ErrorIs(t, node.swarm.check(tampered), ErrBadMAC)
+
+	// A public node accepts messages with or without a MAC
+	network.SetSwarmKey(nil)
+	assert.Nil(t, network.SwarmKey())
+	assert.NoError(t, node.swarm.check(rpc))
+}
+
+func TestReadSwarmKey(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "swarm.key")
+	assert.NoError(t, os.WriteFile(path, []byte("  hemlig nyckel\n"), 0600))
+
+	key, err := ReadSwarmKey(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hemlig nyckel"), key)
+
+	assert.NoError(t, os.WriteFile(path, []byte("\n"), 0600))
+	_, err = ReadSwarmKey(path)
+	assert.Error(t, err)
+	_, err = ReadSwarmKey(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
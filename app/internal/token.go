@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// errBadToken refuses a StoreRequest without a valid token
+var errBadToken = &RemoteError{Code: CodeBadToken, Message: "missing or expired store token"}
+
+// The secret tokens are made with is replaced this often. Tokens made with
+// the one before are still accepted, so a token is good for at least this
+// long and at most twice as long.
+const tokenRotation = 5 * time.Minute
+
+// Bytes of the HMAC handed out as a token
+const tokenSize = 16
+
+// storeTokens gates STORE like the announce tokens of BitTorrent's DHT.
+// Every FindContactResponse and FindDataResponse carries a token bound to
+// the ID and address the request came from, and a StoreRequest is only
+// accepted with a token we handed out to that ID at that address. Someone
+// who fakes the source address of their requests never sees the answers,
+// so they can not make us store anything in another node's name, nor make
+// us send StoreResponses to a node that did not ask for them.
+//
+// The tokens we were given by others are kept as well, to send along with
+// our own stores.
+type storeTokens struct {
+	mu       sync.Mutex
+	current  []byte
+	previous []byte
+	rotated  time.Time
+	received map[KademliaID]receivedToken
+	now      func() time.Time
+}
+
+type receivedToken struct {
+	token []byte
+	at    time.Time
+}
+
+func newStoreTokens() *storeTokens {
+	tokens := &storeTokens{
+		received: make(map[KademliaID]receivedToken),
+		now:      time.Now,
+	}
+	tokens.current = newTokenSecret()
+	tokens.previous = tokens.current
+	tokens.rotated = tokens.now()
+	return tokens
+}
+
+func newTokenSecret() []byte {
+	secret := make([]byte, sha256.Size)
+	_, err := rand.Read(secret)
+	mustRandom(err)
+	return secret
+}
+
+// issue makes the token for a requester
+func (tokens *storeTokens) issue(requester Contact) []byte {
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+
+	tokens.rotate(tokens.now())
+	return tokenFor(tokens.current, requester)
+}
+
+// valid reports whether token was issued to requester within the last two
+// rotations
+func (tokens *storeTokens) valid(requester Contact, token []byte) bool {
+	if len(token) != tokenSize || requester.ID == nil {
+		return false
+	}
+
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+
+	tokens.rotate(tokens.now())
+	return hmac.Equal(token, tokenFor(tokens.current, requester)) ||
+		hmac.Equal(token, tokenFor(tokens.previous, requester))
+}
+
+func (tokens *storeTokens) rotate(now time.Time) {
+	if now.Sub(tokens.rotated) < tokenRotation {
+		return
+	}
+	tokens.previous = tokens.current
+	tokens.current = newTokenSecret()
+	tokens.rotated = now
+
+	// Received tokens that old would be refused anyway
+	for peer, received := range tokens.received {
+		if now.Sub(received.at) >= tokenRotation {
+			delete(tokens.received, peer)
+		}
+	}
+}
+
+func tokenFor(secret []byte, requester Contact) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(requester.ID[:])
+	mac.Write([]byte(requester.Address))
+	return mac.Sum(nil)[:tokenSize]
+}
+
+// remember keeps a token peer handed to us
+func (tokens *storeTokens) remember(peer *KademliaID, token []byte) {
+	if peer == nil || len(token) == 0 {
+		return
+	}
+
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+
+	now := tokens.now()
+	tokens.rotate(now)
+	tokens.received[*peer] = receivedToken{token: token, at: now}
+}
+
+// lookup returns a token from peer that is certain to still be accepted
+func (tokens *storeTokens) lookup(peer *KademliaID) ([]byte, bool) {
+	if peer == nil {
+		return nil, false
+	}
+
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+
+	received, found := tokens.received[*peer]
+	if !found || tokens.now().Sub(received.at) >= tokenRotation {
+		return nil, false
+	}
+	return received.token, true
+}
+
+func (tokens *storeTokens) forget(peer *KademliaID) {
+	if peer == nil {
+		return
+	}
+
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+
+	delete(tokens.received, *peer)
+}
+
+// storeToken returns a token for storing key on contact. Without one from an
+// earlier lookup the contact is asked for the nodes closest to key, which
+// hands us a new one.
+func (network *Network) storeToken(contact *Contact, key string) ([]byte, error) {
+	tokens := network.Node.tokens
+	if token, found := tokens.lookup(contact.ID); found {
+		return token, nil
+	}
+
+	if _, err := network.SendFindContactMessage(contact, NewKademliaID(key)); err != nil {
+		return nil, err
+	}
+	// The token is remembered under the ID the response was signed with,
+	// which is the one we store with as long as the contact is who we think
+	token, found := tokens.lookup(contact.ID)
+	if !found {
+		return nil, fmt.Errorf("%w: no store token from %v", ErrBadResponse, contact.Address)
+	}
+	return token, nil
+}
+
+// isBadToken reports whether a store was refused for its token
+func isBadToken(err error) bool {
+	var remoteErr *RemoteError
+	return errors.As(err, &remoteErr) && remoteErr.Code == CodeBadToken
+}
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStoreTokens(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tokens := newStoreTokens()
+	tokens.now = func() time.Time { return now }
+	tokens.rotated = now
+
+	requester := NewContact(NewRandomKademliaID(), "10.9.0.2:1337")
+	token := tokens.issue(requester)
+	assert.Len(t, token, tokenSize)
+	assert.True(t, tokens.valid(requester, token))
+
+	// The token only works for the ID and address it was given to
+	assert.False(t, tokens.valid(NewContact(requester.ID, "10.9.0.3:1337"), token))
+	assert.False(t, tokens.valid(NewContact(NewRandomKademliaID(), requester.Address), token))
+	assert.False(t, tokens.valid(requester, nil))
+
+	// It survives one rotation of the secret, but not two
+	now = now.Add(tokenRotation)
+	assert.True(t, tokens.valid(requester, token))
+	assert.NotEqual(t, token, tokens.issue(requester))
+	now = now.Add(tokenRotation)
+	assert.False(t, tokens.valid(requester, token))
+}
+
+func TestReceivedStoreTokens(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tokens := newStoreTokens()
+	tokens.now = func() time.Time { return now }
+	tokens.rotated = now
+
+	peer := NewRandomKademliaID()
+	tokens.remember(peer, []byte{1, 2, 3})
+	token, found := tokens.lookup(peer)
+	assert.True(t, found)
+	assert.Equal(t, []byte{1, 2, 3}, token)
+
+	// Tokens are only used while they are certain to be accepted
+	now = now.Add(tokenRotation)
+	_, found = tokens.lookup(peer)
+	assert.False(t, found)
+	tokens.issue(NewContact(peer, "10.9.0.1:1337"))
+	assert.Empty(t, tokens.received)
+}
+
+func TestStoreNeedsToken(t *testing.T) {
+	switchboard := NewSwitchboard()
+	node := startMemoryNode(t, switchboard, "10.9.1.1:1337")
+	other := startMemoryNode(t, switchboard, "10.9.1.2:1337")
+	network := &Network{Node: other}
+
+	// A store without a token is refused
+	storeData, _ := json.Marshal(StoreRequest{Key: "abc", Data: "Lagrar saker"})
+	request := RPC{Type: "StoreRequest", Version: ProtocolVersion, Sender: other.Self, RpcID: NewRandomKademliaID(), Data: storeData}
+	_, err := network.exchange(&node.Self, request)
+	assert.Equal(t, CodeBadToken, errorCode(err))
+	_, found := node.Datastore.getData("abc")
+	assert.False(t, found)
+
+	// SendStoreMessage asks for a token first if it has none
+	data := []byte("Lagrar saker med token")
+	key, err := network.SendStoreMessage(data, &node.Self)
+	assert.NoError(t, err)
+	stored, found := node.Datastore.getData(key)
+	assert.True(t, found)
+	assert.Equal(t, data, stored)
+
+	// A token the node no longer accepts is replaced
+	other.tokens.remember(node.Self.ID, make([]byte, tokenSize))
+	_, err = network.SendStoreMessage([]byte("Lagrar mer"), &node.Self)
+	assert.NoError(t, err)
+
+	// Tokens from the lookup are used for the stores that follow it
+	third := startMemoryNode(t, switchboard, "10.9.1.3:1337")
+	third.JoinNetwork(context.Background(), &node.Self)
+	_, err = third.Store(context.Background(), []byte("Lagrar efter lookup"))
+	assert.NoError(t, err)
+	_, found = third.tokens.lookup(node.Self.ID)
+	assert.True(t, found)
+}
+
+func TestStoreTokenFromSpoofedAddress(t *testing.T) {
+	switchboard := NewSwitchboard()
+	node := startMemoryNode(t, switchboard, "10.9.2.1:1337")
+	victim := NewKademliaNode("10.9.2.2:1337")
+	attacker, _ := switchboard.Listen("10.9.2.3:1337")
+	defer attacker.Close()
+
+	// The token the victim would get is useless from any other address
+	token := node.tokens.issue(victim.Self)
+	storeData, _ := json.Marshal(StoreRequest{Key: "abc", Data: "Förfalskad", Token: token})
+	request := RPC{Type: "StoreRequest", Sender: victim.Self, RpcID: NewRandomKademliaID(), Data: storeData}
+	stamp(&request)
+	assert.NoError(t, (&Network{Node: &victim}).sign(&request))
+	encoded, _ := BinaryCodec{}.Encode(request)
+	assert.NoError(t, attacker.Send(node.Self.Address, encoded))
+
+	buffer := make([]byte, maxDatagramSize)
+	n, _, err := attacker.Receive(buffer)
+	assert.NoError(t, err)
+	response, err := DeserializeRPC(buffer[:n])
+	assert.NoError(t, err)
+	assert.Equal(t, CodeBadToken, errorCode(remoteError(response)))
+	_, found := node.Datastore.getData("abc")
+	assert.False(t, found)
+}
@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// Transport moves datagrams between nodes. Network only needs to send a
+// datagram to an address, receive the next one and know its own address, so
+// anything that can do that can carry the Kademlia protocol.
+type Transport interface {
+	// Send delivers one datagram to address. Like UDP, delivery is not
+	// guaranteed and no error is returned when nobody is listening.
+	Send(address string, datagram []byte) error
+
+	// Receive blocks until a datagram arrives, copies it into buffer and
+	// returns its length together with the address of the sender.
+	Receive(buffer []byte) (int, string, error)
+
+	// LocalAddr returns the address other nodes reach this transport on
+	LocalAddr() string
+
+	Close() error
+}
+
+var ErrTransportClosed = errors.New("transport is closed")
+
+// UDPTransport is the Transport used between real nodes
+type UDPTransport struct {
+	conn *net.UDPConn
+}
+
+// NewUDPTransport binds a UDP socket on address, e.g. "172.20.0.3:1337"
+func NewUDPTransport(address string) (*UDPTransport, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &UDPTransport{conn: conn}, nil
+}
+
+func (transport *UDPTransport) Send(address string, datagram []byte) error {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+
+	_, err = transport.conn.WriteToUDP(datagram, addr)
+	return err
+}
+
+func (transport *UDPTransport) Receive(buffer []byte) (int, string, error) {
+	n, addr, err := transport.conn.ReadFromUDP(buffer)
+	if err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			return 0, "", ErrTransportClosed
+		}
+		return 0, "", err
+	}
+	return n, addr.String(), nil
+}
+
+func (transport *UDPTransport) LocalAddr() string {
+	return transport.conn.LocalAddr().String()
+}
+
+func (transport *UDPTransport) Close() error {
+	return transport.conn.Close()
+}
+
+// How many datagrams wait in an in-memory inbox before new ones are dropped
+const switchboardQueueSize = 1024
+
+// Switchboard connects in-memory transports by address, so a whole network
+// of nodes can run inside a single process without touching real sockets.
+type Switchboard struct {
+	mu         sync.RWMutex
+	transports map[string]*memoryTransport
+}
+
+func NewSwitchboard() *Switchboard {
+	return &Switchboard{
+		transports: make(map[string]*memoryTransport),
+	}
+}
+
+// Listen returns a transport reachable on address through the switchboard
+func (switchboard *Switchboard) Listen(address string) (Transport, error) {
+	switchboard.mu.Lock()
+	defer switchboard.mu.Unlock()
+
+	if _, found := switchboard.transports[address]; found {
+		return nil, errors.New("address already in use: " + address)
+	}
+
+	transport := &memoryTransport{
+		switchboard: switchboard,
+		address:     address,
+		inbox:       make(chan datagram, switchboardQueueSize),
+		closed:      make(chan struct{}),
+	}
+	switchboard.transports[address] = transport
+	return transport, nil
+}
+
+func (switchboard *Switchboard) lookup(address string) (*memoryTransport, bool) {
+	switchboard.mu.RLock()
+	defer switchboard.mu.RUnlock()
+
+	transport, found := switchboard.transports[address]
+	return transport, found
+}
+
+func (switchboard *Switchboard) remove(address string) {
+	switchboard.mu.Lock()
+	defer switchboard.mu.Unlock()
+
+	delete(switchboard.transports, address)
+}
+
+type datagram struct {
+	from string
+	data []byte
+}
+
+type memoryTransport struct {
+	switchboard *Switchboard
+	address     string
+	inbox       chan datagram
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+func (transport *memoryTransport) Send(address string, data []byte) error {
+	select {
+	case <-transport.closed:
+		return ErrTransportClosed
+	default:
+	}
+
+	receiver, found := transport.switchboard.lookup(address)
+	if !found {
+		return nil // Nobody listening, the datagram is lost just like with UDP
+	}
+
+	// The sender may reuse its buffer, so the receiver gets its own copy
+	message := datagram{from: transport.address, data: append([]byte(nil), data...)}
+	select {
+	case receiver.inbox <- message:
+	case <-receiver.closed:
+	default:
+		// Inbox is full, drop the datagram
+	}
+	return nil
+}
+
+func (transport *memoryTransport) Receive(buffer []byte) (int, string, error) {
+	select {
+	case message := <-transport.inbox:
+		n := copy(buffer, message.data)
+		return n, message.from, nil
+	case <-transport.closed:
+		return 0, "", ErrTransportClosed
+	}
+}
+
+func (transport *memoryTransport) LocalAddr() string {
+	return transport.address
+}
+
+func (transport *memoryTransport) Close() error {
+	transport.closeOnce.Do(func() {
+		close(transport.closed)
+		transport.switchboard.remove(transport.address)
+	})
+	return nil
+}
@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startMemoryNode creates a node served through the switchboard
+func startMemoryNode(t *testing.T, switchboard *Switchboard, address string) *Kademlia {
+	node := NewKademliaNode(address)
+	transport, err := switchboard.Listen(address)
+	assert.NoError(t, err)
+
+	network := &Network{Node: &node}
+	go network.Serve(context.Background(), transport)
+	t.Cleanup(func() { node.Close() })
+
+	return &node
+}
+
+func TestSwitchboardTransport(t *testing.T) {
+	switchboard := NewSwitchboard()
+	first, err := switchboard.Listen("10.0.0.1:1337")
+	assert.NoError(t, err)
+	second, err := switchboard.Listen("10.0.0.2:1337")
+	assert.NoError(t, err)
+
+	// Addresses can only be taken once
+	_, err = switchboard.Listen("10.0.0.1:1337")
+	assert.Error(t, err)
+
+	assert.NoError(t, first.Send("10.0.0.2:1337", []byte("hello")))
+	buffer := make([]byte, 64)
+	n, from, err := second.Receive(buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buffer[:n]))
+	assert.Equal(t, "10.0.0.1:1337", from)
+
+	// Datagrams to unknown addresses are lost without an error
+	assert.NoError(t, first.Send("10.0.0.3:1337", []byte("hello")))
+
+	second.Close()
+	_, _, err = second.Receive(buffer)
+	assert.ErrorIs(t, err, ErrTransportClosed)
+	assert.NoError(t, first.Send("10.0.0.2:1337", []byte("hello")))
+}
+
+func TestInMemoryNetwork(t *testing.T) {
+	switchboard := NewSwitchboard()
+	bootstrap := startMemoryNode(t, switchboard, "10.0.0.1:1337")
+
+	// A hundred refresh sweeps after joining cost more than they are worth
+	// here, the lookup for each node's own ID fills its table well enough
+	nodes := []*Kademlia{bootstrap}
+	for i := 2; i <= 100; i++ {
+		node := startMemoryNode(t, switchboard, fmt.Sprintf("10.0.%d.%d:1337", i/250, i%250))
+		(&Network{Node: node}).SetRefreshInterval(0)
+		node.JoinNetwork(context.Background(), &bootstrap.Self)
+		nodes = append(nodes, node)
+	}
+
+	dataToStore := []byte("Lagrar saker i minnet")
+	hash, err := nodes[42].Store(context.Background(), dataToStore)
+	assert.NoError(t, err)
+
+	_, retrievedData, _ := nodes[77].Lookup(context.Background(), hash)
+	assert.Equal(t, dataToStore, retrievedData)
+}
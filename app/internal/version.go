@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// ProtocolVersion is the version of the RPC envelope and payloads this node
+// speaks. It is bumped whenever a payload changes in an incompatible way.
+const ProtocolVersion uint16 = 3
+
+// Oldest protocol version we still answer. Nodes from before versioning was
+// introduced send no version at all, which is read as version 1. Messages
+// are signed since version 2 and carry a timestamp against replays since
+// version 3, so older nodes can no longer take part.
+const minProtocolVersion uint16 = 3
+
+// Capability is a bitmap of optional protocol features a node supports
+type Capability uint64
+
+const (
+	CapBinaryCodec   Capability = 1 << iota // Understands BinaryCodec messages
+	CapFragmentation                        // Reassembles fragmented messages
+	CapNodeInfo                             // Answers NodeInfoRequest
+	CapEncryption                           // Answers HandshakeRequest and encrypted requests
+)
+
+// Capabilities of this implementation, advertised in every envelope
+const localCapabilities = CapBinaryCodec | CapFragmentation | CapNodeInfo | CapEncryption
+
+// Has reports whether every capability in c is present
+func (capabilities Capability) Has(c Capability) bool {
+	return capabilities&c == c
+}
+
+// effectiveVersion returns the version a message was sent with
+func effectiveVersion(rpc RPC) uint16 {
+	if rpc.Version == 0 {
+		return 1
+	}
+	return rpc.Version
+}
+
+func supportedVersion(rpc RPC) bool {
+	version := effectiveVersion(rpc)
+	return version >= minProtocolVersion && version <= ProtocolVersion
+}
+
+// stamp fills in the protocol version, capabilities and send time of an
+// outgoing message
+func stamp(rpc *RPC) {
+	rpc.Version = ProtocolVersion
+	rpc.Capabilities = localCapabilities
+	rpc.Timestamp = time.Now().UnixNano()
+}
+
+// Peers whose capabilities are remembered at most
+const maxKnownPeers = 4096
+
+// peerCapabilities remembers what the peers we heard from advertised in
+// their envelopes, by address, so we only use features they understand
+type peerCapabilities struct {
+	mu    sync.Mutex
+	known map[string]Capability
+}
+
+func newPeerCapabilities() *peerCapabilities {
+	return &peerCapabilities{known: make(map[string]Capability)}
+}
+
+// record notes the capabilities of a verified message from address
+func (peers *peerCapabilities) record(address string, capabilities Capability) {
+	peers.mu.Lock()
+	defer peers.mu.Unlock()
+
+	if _, found := peers.known[address]; !found && len(peers.known) >= maxKnownPeers {
+		// Any peer will do, one we forget is simply asked again
+		for forgotten := range peers.known {
+			delete(peers.known, forgotten)
+			break
+		}
+	}
+	peers.known[address] = capabilities
+}
+
+// lookup returns what the peer at address advertised, if we heard from it
+func (peers *peerCapabilities) lookup(address string) (Capability, bool) {
+	peers.mu.Lock()
+	defer peers.mu.Unlock()
+
+	capabilities, found := peers.known[address]
+	return capabilities, found
+}
+
+// codecFor returns the encoding for requests to contact. BinaryCodec is only
+// used once the contact advertised it, every node understands JSON.
+func (network *Network) codecFor(contact *Contact) Codec {
+	codec := network.Codec()
+	if _, binary := codec.(BinaryCodec); !binary {
+		return codec
+	}
+
+	capabilities, found := network.Node.peers.lookup(contact.Address)
+	if !found || !capabilities.Has(CapBinaryCodec) {
+		return JSONCodec{}
+	}
+	return codec
+}
+
+// encryptsFor reports whether requests to contact are encrypted: when
+// encryption is on and the contact has not shown that it can not do it.
+// Contacts we never heard from are sent a handshake, whose answer tells.
+func (network *Network) encryptsFor(contact *Contact) bool {
+	if !network.Encryption() {
+		return false
+	}
+
+	capabilities, found := network.Node.peers.lookup(contact.Address)
+	return !found || capabilities.Has(CapEncryption)
+}
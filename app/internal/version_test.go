@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startLimitedPeer runs a node that only advertises the given capabilities.
+// It answers pings, refuses every other request and passes on what it
+// received.
+func startLimitedPeer(t *testing.T, switchboard *Switchboard, address string, capabilities Capability) (*Kademlia, chan RPC) {
+	peer := NewKademliaNode(address)
+	network := &Network{Node: &peer}
+	transport, err := switchboard.Listen(address)
+	assert.NoError(t, err)
+	t.Cleanup(func() { transport.Close() })
+
+	received := make(chan RPC, 16)
+	go func() {
+		buffer := make([]byte, maxDatagramSize)
+		for {
+			n, from, err := transport.Receive(buffer)
+			if err != nil {
+				return
+			}
+			request, err := DeserializeRPC(buffer[:n])
+			if err != nil {
+				continue
+			}
+			request.Data = append(json.RawMessage(nil), request.Data...)
+			received <- request
+
+			var response RPC
+			if request.Type == "PingRequest" {
+				pongData, _ := json.Marshal(PingResponse{PongID: NewRandomKademliaID()})
+				response = RPC{Type: "PingResponse", Sender: peer.Self, RpcID: request.RpcID, Data: pongData}
+			} else {
+				response, _ = network.createUnsupportedResponse(request, "unknown RPC request type")
+			}
+			stamp(&response)
+			response.Capabilities = capabilities
+			network.sign(&response)
+			encoded, _ := JSONCodec{}.Encode(response)
+			transport.Send(from, encoded)
+		}
+	}()
+
+	return &peer, received
+}
+
+func TestBinaryCodecOnlyForCapablePeers(t *testing.T) {
+	switchboard := NewSwitchboard()
+	node := startMemoryNode(t, switchboard, "10.13.3.1:1337")
+	network := &Network{Node: node}
+	network.SetCodec(BinaryCodec{})
+
+	peer, received := startLimitedPeer(t, switchboard, "10.13.3.2:1337", CapFragmentation)
+
+	// Neither the first request nor those after the peer told us what it
+	// supports are binary
+	for i := 0; i < 2; i++ {
+		_, err := network.SendPingMessage(&peer.Self)
+		assert.NoError(t, err)
+		request := <-received
+		assert.Equal(t, "PingRequest", request.Type)
+		assert.IsType(t, JSONCodec{}, network.codecFor(&peer.Self))
+	}
+
+	// Peers that advertise it get binary
+	capable := startMemoryNode(t, switchboard, "10.13.3.3:1337")
+	assert.IsType(t, JSONCodec{}, network.codecFor(&capable.Self))
+	_, err := network.SendPingMessage(&capable.Self)
+	assert.NoError(t, err)
+	assert.IsType(t, BinaryCodec{}, network.codecFor(&capable.Self))
+}
+
+func TestPlaintextForPeersWithoutEncryption(t *testing.T) {
+	switchboard := NewSwitchboard()
+	node := startMemoryNode(t, switchboard, "10.13.4.1:1337")
+	network := &Network{Node: node}
+	network.SetEncryption(true)
+
+	peer, received := startLimitedPeer(t, switchboard, "10.13.4.2:1337", CapBinaryCodec|CapFragmentation)
+
+	// The handshake is refused, so the ping follows in plaintext
+	_, err := network.SendPingMessage(&peer.Self)
+	assert.NoError(t, err)
+	assert.Equal(t, "HandshakeRequest", (<-received).Type)
+	ping := <-received
+	assert.Equal(t, "PingRequest", ping.Type)
+	assert.False(t, ping.Encrypted)
+
+	// Later requests skip the handshake
+	_, err = network.SendPingMessage(&peer.Self)
+	assert.NoError(t, err)
+	assert.Equal(t, "PingRequest", (<-received).Type)
+	select {
+	case extra := <-received:
+		t.Errorf("Unexpected %s", extra.Type)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPeerCapabilitiesAreBounded(t *testing.T) {
+	peers := newPeerCapabilities()
+	for i := 0; i < maxKnownPeers+10; i++ {
+		peers.record(fmt.Sprintf("10.1.%d.%d:1337", i/256, i%256), CapNodeInfo)
+	}
+	assert.Len(t, peers.known, maxKnownPeers)
+
+	peers.record("10.0.0.1:1337", CapEncryption)
+	capabilities, found := peers.lookup("10.0.0.1:1337")
+	assert.True(t, found)
+	assert.Equal(t, CapEncryption, capabilities)
+}
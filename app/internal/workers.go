@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"hash/fnv"
+	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// Default size of the pool handling incoming requests, one worker per CPU.
+// Handlers spend most of their time waiting on locks and the network, so
+// even a single CPU gets minWorkers and requests are never handled one at
+// a time.
+var defaultWorkers = max(minWorkers, runtime.NumCPU())
+
+const minWorkers = 4
+
+// Requests waiting per worker before new ones are dropped
+const defaultQueueSize = 256
+
+// ServeStats shows how the request worker pool keeps up with the load and
+// what the rate limits kept out
+type ServeStats struct {
+	Workers   int    // Number of workers handling requests
+	QueueSize int    // Capacity of each worker's queue
+	Queued    int    // Requests waiting to be handled right now
+	Handled   uint64 // Requests answered since Serve started
+	Dropped   uint64 // Requests dropped because the queue of their worker was full
+
+	RateLimited uint64 // Messages dropped by the rate limits
+	Malformed   uint64 // Messages that could not be read or verified
+	Ignored     uint64 // Messages dropped because their source is banned
+	BannedPeers int    // Source IPs banned right now
+}
+
+type incomingRequest struct {
+	rpc   RPC
+	codec Codec // Encoding to answer in
+	from  string
+}
+
+// workerPool handles requests concurrently. Every sender is bound to one
+// worker, so requests from the same node are still answered in order while a
+// slow request only holds up the senders sharing its worker.
+type workerPool struct {
+	queues  []chan incomingRequest
+	wg      sync.WaitGroup
+	handled atomic.Uint64
+	dropped atomic.Uint64
+}
+
+type workerSettings struct {
+	mu        sync.Mutex
+	workers   int
+	queueSize int
+	pool      *workerPool // The pool of the running Serve, if any
+}
+
+func newWorkerSettings() *workerSettings {
+	return &workerSettings{
+		workers:   defaultWorkers,
+		queueSize: defaultQueueSize,
+	}
+}
+
+// SetWorkers sets how many requests are handled concurrently and how many may
+// wait for each worker. It takes effect the next time Serve is started.
+func (network *Network) SetWorkers(workers int, queueSize int) {
+	settings := network.Node.workers
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	settings.workers = workers
+	settings.queueSize = queueSize
+}
+
+// Stats returns the current backpressure figures of the request workers and
+// what the rate limits dropped
+func (network *Network) Stats() ServeStats {
+	settings := network.Node.workers
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+
+	stats := ServeStats{
+		Workers:   settings.workers,
+		QueueSize: settings.queueSize,
+	}
+	limiter := network.Node.limiter
+	limiter.mu.Lock()
+	stats.RateLimited = limiter.limited
+	stats.Malformed = limiter.malformed
+	stats.Ignored = limiter.ignored
+	limiter.mu.Unlock()
+	stats.BannedPeers = len(network.Banned())
+
+	if pool := settings.pool; pool != nil {
+		for _, queue := range pool.queues {
+			stats.Queued += len(queue)
+		}
+		stats.Handled = pool.handled.Load()
+		stats.Dropped = pool.dropped.Load()
+	}
+	return stats
+}
+
+// startWorkers starts the pool that answers requests arriving on transport
+func (network *Network) startWorkers(transport Transport, limit int) *workerPool {
+	settings := network.Node.workers
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+
+	pool := &workerPool{
+		queues: make([]chan incomingRequest, settings.workers),
+	}
+	for i := range pool.queues {
+		queue := make(chan incomingRequest, settings.queueSize)
+		pool.queues[i] = queue
+
+		pool.wg.Add(1)
+		go func() {
+			defer pool.wg.Done()
+			for request := range queue {
+				network.handleRequest(transport, request, limit)
+				pool.handled.Add(1)
+			}
+		}()
+	}
+	settings.pool = pool
+	return pool
+}
+
+// dispatch queues a request with the worker of its sender. When that worker
+// is too far behind the request is dropped, just like a lost datagram.
+func (pool *workerPool) dispatch(request incomingRequest) {
+	queue := pool.queues[workerFor(request.from, len(pool.queues))]
+
+	select {
+	case queue <- request:
+	default:
+		pool.dropped.Add(1)
+		log.Printf("Dropping %s from %v: worker queue is full", request.rpc.Type, request.from)
+	}
+}
+
+// workerFor picks the worker that handles every request from a sender
+func workerFor(from string, workers int) int {
+	hasher := fnv.New32a()
+	hasher.Write([]byte(from))
+	return int(hasher.Sum32() % uint32(workers))
+}
+
+// stop lets the workers finish the queued requests and waits for them
+func (pool *workerPool) stop() {
+	for _, queue := range pool.queues {
+		close(queue)
+	}
+	pool.wg.Wait()
+}
@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type BlockRequest struct{}
+
+type BlockResponse struct{}
+
+func TestConcurrentRequestHandling(t *testing.T) {
+	// Requests of the block kind are held until the channel is closed
+	unblock := make(chan struct{})
+	registerTestRPC(t, RPCKind{
+		RequestType:  "BlockRequest",
+		ResponseType: "BlockResponse",
+		Handle: func(network *Network, request RPC) (interface{}, error) {
+			<-unblock
+			return BlockResponse{}, nil
+		},
+		DecodeResponse: func(data json.RawMessage) (interface{}, error) {
+			return BlockResponse{}, nil
+		},
+	})
+
+	switchboard := NewSwitchboard()
+
+	// Requests are handled concurrently without any configuration
+	server := startMemoryNode(t, switchboard, "10.1.0.1:1337")
+	serverNetwork := &Network{Node: server}
+
+	// Find two senders that are handled by different workers
+	slowSender := startMemoryNode(t, switchboard, "10.1.0.2:1337")
+	var fastSender *Kademlia
+	for i := 3; fastSender == nil; i++ {
+		address := fmt.Sprintf("10.1.0.%d:1337", i)
+		if workerFor(address, defaultWorkers) != workerFor(slowSender.Self.Address, defaultWorkers) {
+			fastSender = startMemoryNode(t, switchboard, address)
+		}
+	}
+
+	slowNetwork := &Network{Node: slowSender}
+	slowNetwork.SetRetryPolicy("BlockRequest", RetryPolicy{Timeout: 5 * time.Second})
+	blockErr := make(chan error)
+	go func() {
+		_, err := slowNetwork.SendRequest(&server.Self, "BlockRequest", BlockRequest{})
+		blockErr <- err
+	}()
+
+	// The blocked request does not hold up other senders
+	time.Sleep(50 * time.Millisecond)
+	_, err := (&Network{Node: fastSender}).SendPingMessage(&server.Self)
+	assert.NoError(t, err)
+
+	close(unblock)
+	assert.NoError(t, <-blockErr)
+
+	// The counter is updated right after the response went out
+	assert.Eventually(t, func() bool {
+		return serverNetwork.Stats().Handled == 2
+	}, time.Second, 10*time.Millisecond)
+
+	stats := serverNetwork.Stats()
+	assert.Equal(t, defaultWorkers, stats.Workers)
+	assert.GreaterOrEqual(t, stats.Workers, minWorkers)
+	assert.Equal(t, defaultQueueSize, stats.QueueSize)
+	assert.Equal(t, 0, stats.Queued)
+	assert.Equal(t, uint64(0), stats.Dropped)
+}
+
+func TestWorkerQueueBackpressure(t *testing.T) {
+	pool := &workerPool{queues: []chan incomingRequest{make(chan incomingRequest, 2)}}
+
+	// Nobody takes requests off the queue, so the third one is dropped
+	for i := 0; i < 3; i++ {
+		pool.dispatch(incomingRequest{rpc: RPC{Type: "PingRequest"}, from: "10.2.0.1:1337"})
+	}
+	assert.Len(t, pool.queues[0], 2)
+	assert.Equal(t, uint64(1), pool.dropped.Load())
+
+	// Requests from one sender always go to the same worker
+	assert.Equal(t, workerFor("10.2.0.1:1337", 8), workerFor("10.2.0.1:1337", 8))
+}
+
+func TestSetWorkers(t *testing.T) {
+	node := NewKademliaNode("10.1.1.1:1337")
+	network := &Network{Node: &node}
+
+	network.SetWorkers(8, 32)
+	assert.Equal(t, 8, network.Stats().Workers)
+	assert.Equal(t, 32, network.Stats().QueueSize)
+
+	// A pool needs at least one worker with room for one request
+	network.SetWorkers(0, 0)
+	assert.Equal(t, 1, network.Stats().Workers)
+	assert.Equal(t, 1, network.Stats().QueueSize)
+}